@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// patchContentType labels payloads that are a unified diff or the output of
+// git format-patch
+const patchContentType = "text/x-patch"
+
+// ApplyResult is what nd apply reports
+type ApplyResult struct {
+	SolutionID string   `json:"solution_id"`
+	NeedID     string   `json:"need_id,omitempty"`
+	DryRun     bool     `json:"dry_run"`
+	Applied    bool     `json:"applied"`
+	Files      []string `json:"files"`
+	Conflicts  []string `json:"conflicts,omitempty"`
+}
+
+// isPatchType reports whether contentType labels a patch
+func isPatchType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == patchContentType || mediaType == "text/x-diff"
+}
+
+// workingTreeDiff returns the uncommitted changes in the current checkout,
+// staged or not, as a patch. Untracked files are not included.
+func workingTreeDiff() (string, error) {
+	out, err := runGit("", nil, "diff", "--binary", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to capture the working tree diff: %w", err)
+	}
+	if len(out) == 0 {
+		return "", errors.New("no changes to send: the working tree matches HEAD (untracked files need git add -N first)")
+	}
+	return string(out), nil
+}
+
+// handleApply fetches a solution carrying a patch and applies it to the
+// checkout in the current directory. The patch is always checked first;
+// when it does not apply cleanly nothing is changed, the conflicts are
+// reported with the result and true is returned. A dry run stops after the
+// check.
+func handleApply(msgID string, dryRun bool) (bool, error) {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return false, fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	root, err := runGit("", nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return false, fmt.Errorf("nd apply must run inside a git checkout: %w", err)
+	}
+	dir := strings.TrimSpace(string(root))
+
+	nc, err := connect()
+	if err != nil {
+		return false, err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"msg_id":    msgID,
+	}
+	var resp struct {
+		Message Message `json:"message"`
+	}
+	if err := request(nc, "needy.get", req, 5*time.Second, &resp); err != nil {
+		return false, err
+	}
+	solution := resp.Message
+
+	if solution.Type != "solution" {
+		return false, fmt.Errorf("message %s is a %s, not a solution", msgID, solution.Type)
+	}
+	if !isPatchType(solution.ContentType) {
+		return false, fmt.Errorf("solution %s does not carry a patch (content type %q). Fetch it with: nd get %s", msgID, solution.ContentType, msgID)
+	}
+
+	r, err := openPayload(nc, solution)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = r.Close() }()
+	patch, err := io.ReadAll(r)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch payload of message %s: %w", msgID, err)
+	}
+
+	result := ApplyResult{SolutionID: solution.ID, NeedID: solution.NeedID, DryRun: dryRun, Files: []string{}}
+
+	numstat, err := runGit(dir, patch, "apply", "--numstat", "-")
+	if err != nil {
+		return false, fmt.Errorf("solution %s is not a valid patch: %w", msgID, err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(numstat)), "\n") {
+		// Each line is: added, deleted, path
+		if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+			result.Files = append(result.Files, fields[2])
+		}
+	}
+
+	if _, err := runGit(dir, patch, "apply", "--check", "-"); err != nil {
+		result.Conflicts = patchConflicts(err)
+	} else if !dryRun {
+		if _, err := runGit(dir, patch, "apply", "-"); err != nil {
+			return false, fmt.Errorf("failed to apply solution %s: %w", msgID, err)
+		}
+		result.Applied = true
+	}
+
+	emit(result, func() {
+		switch {
+		case len(result.Conflicts) > 0:
+			fmt.Printf("Solution %s does not apply cleanly to this checkout:\n", result.SolutionID)
+			for _, c := range result.Conflicts {
+				fmt.Printf("  %s\n", c)
+			}
+			fmt.Println("Nothing was changed.")
+		case result.Applied:
+			fmt.Printf("Applied solution %s to %d file(s):\n", result.SolutionID, len(result.Files))
+		default:
+			fmt.Printf("Solution %s applies cleanly to %d file(s):\n", result.SolutionID, len(result.Files))
+		}
+		if len(result.Conflicts) == 0 {
+			for _, f := range result.Files {
+				fmt.Printf("  %s\n", f)
+			}
+		}
+		if result.DryRun && len(result.Conflicts) == 0 {
+			fmt.Printf("\nApply it with: nd apply %s\n", result.SolutionID)
+		}
+	})
+
+	return len(result.Conflicts) > 0, nil
+}
+
+// patchConflicts extracts the reasons git apply gave for refusing a patch
+func patchConflicts(err error) []string {
+	var conflicts []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if reason, ok := strings.CutPrefix(strings.TrimSpace(line), "error: "); ok {
+			conflicts = append(conflicts, reason)
+		}
+	}
+	if len(conflicts) == 0 {
+		conflicts = append(conflicts, err.Error())
+	}
+	return conflicts
+}
+
+// runGit runs git with args in dir (the current directory if empty),
+// feeding it stdin, and returns its output. A failure carries git's own
+// error output.
+func runGit(dir string, stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
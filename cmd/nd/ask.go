@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// askPollInterval is how long each server-side wait for a solution lasts
+// before nd ask asks again on the same connection
+const askPollInterval = 30 * time.Second
+
+// handleAsk broadcasts a need and blocks until a solution to it arrives,
+// then prints the solution's payload. Other traffic is ignored and the
+// agent's mailbox is left untouched. A zero timeout waits until interrupted.
+// Giving up leaves the need open; an answer on it tells the agents working
+// on it that nobody is waiting any more.
+func handleAsk(text string, payload Payload, opts NeedOptions, timeout time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect(nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	need, err := postMessage(nc, clientID, "need", text, "", "", payload, opts)
+	if err != nil {
+		return err
+	}
+
+	// Giving up leaves the need open, so say how to follow it up
+	giveUp := func(reason string) {
+		text := fmt.Sprintf("No longer waiting for a solution (%s); the need stays open", reason)
+		_, _ = postMessage(nc, clientID, "cancel", text, need.ID, "", Payload{}, NeedOptions{})
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		giveUp("nd ask was cancelled")
+		fail(withCode(exitInterrupted, fmt.Errorf("cancelled while waiting for a solution to need %s. Follow it with: nd thread %s", need.ID, need.ID)))
+	}()
+
+	if isText() {
+		fmt.Fprintf(os.Stderr, "Sent need %s, waiting for a solution...\n", need.ID)
+		if len(need.RoutedTo) > 0 {
+			fmt.Fprintf(os.Stderr, "Routed to %s.\n", strings.Join(need.RoutedTo, ", "))
+		}
+		if need.Warning != "" {
+			fmt.Fprintf(os.Stderr, "Warning: %s\n", need.Warning)
+		}
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	for {
+		wait := askPollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				giveUp(fmt.Sprintf("nd ask timed out after %s", timeout))
+				return withCode(exitTimeout, fmt.Errorf("no solution to need %s within %s. Follow it with: nd thread %s", need.ID, timeout, need.ID))
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+
+		req := map[string]interface{}{
+			"client_id":  clientID,
+			"need_id":    need.ID,
+			"timeout_ms": wait.Milliseconds(),
+		}
+		var resp struct {
+			Solution *Message `json:"solution"`
+		}
+		if err := request(nc, "needy.await", req, wait+500*time.Millisecond, &resp); err != nil {
+			if exitCodeFor(err) != exitError || nc.IsReconnecting() {
+				// Server busy or restarting; try again shortly
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+		if resp.Solution == nil {
+			continue
+		}
+
+		solution := *resp.Solution
+		if isText() {
+			return printPayload(nc, solution)
+		}
+		if err := loadPayload(nc, &solution); err != nil {
+			return err
+		}
+		emit(solution, func() {})
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// HeartbeatResult is what nd heartbeat reports
+type HeartbeatResult struct {
+	Message  string `json:"message"`
+	LastSeen int64  `json:"last_seen"`
+	Online   int    `json:"online"` // Other agents online
+}
+
+// handleHeartbeat tells the server the agent is alive. Every nd command
+// does so implicitly; with a non-zero interval the heartbeat repeats until
+// interrupted, keeping an agent that is busy elsewhere from turning idle.
+func handleHeartbeat(every time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect(nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	// Repeated beats have no single document to wrap, so json is written as jsonl
+	if every > 0 && outputFormat == outputJSON {
+		outputFormat = outputJSONL
+	}
+
+	for {
+		req := map[string]interface{}{
+			"client_id": clientID,
+		}
+		var result HeartbeatResult
+		err := request(nc, "needy.heartbeat", req, 5*time.Second, &result)
+		switch {
+		case err == nil:
+			emit(result, func() {
+				fmt.Printf("%s. %d other agent(s) online.\n", result.Message, result.Online)
+			})
+		case every == 0 || exitCodeFor(err) == exitError && !nc.IsReconnecting():
+			return err
+		default:
+			// Server busy or restarting; the next beat tries again
+			fmt.Fprintf(os.Stderr, "Heartbeat failed: %v\n", err)
+		}
+
+		if every == 0 {
+			return nil
+		}
+		time.Sleep(every)
+	}
+}
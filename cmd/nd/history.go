@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// handleHistory lists the most recent messages you have sent, including the
+// direct messages that never come back to your own mailbox. A zero limit
+// leaves the number to the server.
+func handleHistory(limit int) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+	}
+	if limit > 0 {
+		req["max"] = limit
+	}
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := request(nc, "needy.history", req, 10*time.Second, &resp); err != nil {
+		return err
+	}
+	if resp.Messages == nil {
+		resp.Messages = []Message{}
+	}
+
+	emitList("messages", resp.Messages, nil, func() {
+		if len(resp.Messages) == 0 {
+			fmt.Println("You have not sent any messages.")
+			return
+		}
+		printMessages(resp.Messages)
+	})
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// scratchpadBucket is the key-value bucket agents share state in
+const scratchpadBucket = "SCRATCHPAD"
+
+// KVEntry is one revision of a scratchpad key
+type KVEntry struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Owner     string `json:"owner,omitempty"`
+	Revision  uint64 `json:"revision"`
+	Timestamp int64  `json:"timestamp"`
+	Deleted   bool   `json:"deleted,omitempty"`
+}
+
+// KVResult is what nd kv set and nd kv delete report
+type KVResult struct {
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision,omitempty"`
+	Message  string `json:"message"`
+}
+
+const kvUsage = "nd kv set <key> <value|-> [--if-revision N] | get <key> [--history] | list [prefix] | watch [key] | delete <key> [--if-revision N]"
+
+// runKV parses and runs an nd kv subcommand
+func runKV(args []string) {
+	if len(args) < 1 {
+		usageError("kv subcommand is required (set, get, list, watch, delete)", kvUsage)
+	}
+	subcmd, args := args[0], args[1:]
+
+	// Positional arguments come first, flags after them
+	var positional []string
+	for len(args) > 0 && (args[0] == "-" || !strings.HasPrefix(args[0], "-")) {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+
+	kvCmd := newFlagSet("kv")
+	ifRevision := kvCmd.Uint64("if-revision", 0, "Only write if the key is at this revision (0: only if it does not exist yet)")
+	history := kvCmd.Bool("history", false, "Show every kept revision of the key")
+	timeout := kvCmd.Duration("timeout", 0, "Stop watching after this long (default: until interrupted)")
+	_ = kvCmd.Parse(args)
+	var expect *uint64
+	kvCmd.Visit(func(f *flag.Flag) {
+		if f.Name == "if-revision" {
+			expect = ifRevision
+		}
+	})
+
+	var err error
+	switch subcmd {
+	case "set":
+		if len(positional) != 2 {
+			usageError("key and value are required", "nd kv set <key> <value|-> [--if-revision N]")
+		}
+		value := positional[1]
+		if value == "-" {
+			data, readErr := io.ReadAll(os.Stdin)
+			if readErr != nil {
+				fail(fmt.Errorf("failed to read value from stdin: %w", readErr))
+			}
+			value = string(data)
+		}
+		err = handleKVWrite("set", positional[0], value, expect)
+	case "delete":
+		if len(positional) != 1 {
+			usageError("key is required", "nd kv delete <key> [--if-revision N]")
+		}
+		err = handleKVWrite("delete", positional[0], "", expect)
+	case "get":
+		if len(positional) != 1 {
+			usageError("key is required", "nd kv get <key> [--history]")
+		}
+		err = handleKVGet(positional[0], *history)
+	case "list":
+		if len(positional) > 1 {
+			usageError("at most one prefix is allowed", "nd kv list [prefix]")
+		}
+		prefix := ""
+		if len(positional) == 1 {
+			prefix = positional[0]
+		}
+		err = handleKVList(prefix)
+	case "watch":
+		if len(positional) > 1 {
+			usageError("at most one key is allowed", "nd kv watch [key] [--timeout DURATION]")
+		}
+		key := ">"
+		if len(positional) == 1 {
+			key = positional[0]
+		}
+		err = handleKVWatch(key, *timeout)
+	default:
+		usageError(fmt.Sprintf("unknown kv subcommand '%s'", subcmd), kvUsage)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// handleKVWrite asks the server to set or delete a key. Writes go through
+// the server, which enforces ownership and the expected revision.
+func handleKVWrite(op, key, value string, ifRevision *uint64) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"op":        op,
+		"key":       key,
+	}
+	if op == "set" {
+		req["value"] = value
+	}
+	if ifRevision != nil {
+		req["if_revision"] = *ifRevision
+	}
+
+	var result KVResult
+	if err := request(nc, "needy.kv", req, 5*time.Second, &result); err != nil {
+		return err
+	}
+
+	emit(result, func() {
+		fmt.Println(result.Message)
+		if op == "set" {
+			fmt.Printf("Others can read it with: nd kv get %s\n", key)
+		}
+	})
+	return nil
+}
+
+// scratchpad opens the shared key-value bucket. Reads go to it directly.
+func scratchpad(nc *nats.Conn) (nats.KeyValue, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scratchpad: %w", err)
+	}
+	kv, err := js.KeyValue(scratchpadBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scratchpad: %w", err)
+	}
+	return kv, nil
+}
+
+// kvEntry decodes a stored revision
+func kvEntry(e nats.KeyValueEntry) KVEntry {
+	entry := KVEntry{Key: e.Key(), Revision: e.Revision(), Timestamp: e.Created().Unix()}
+	if e.Operation() != nats.KeyValuePut {
+		entry.Deleted = true
+		return entry
+	}
+	var stored struct {
+		Value string `json:"value"`
+		Owner string `json:"owner"`
+	}
+	_ = json.Unmarshal(e.Value(), &stored)
+	entry.Value, entry.Owner = stored.Value, stored.Owner
+	return entry
+}
+
+// printKVEntry writes one revision of a key
+func printKVEntry(e KVEntry) {
+	if e.Deleted {
+		fmt.Printf("%s deleted (revision %d)\n", e.Key, e.Revision)
+		return
+	}
+	fmt.Printf("%s = %s (revision %d by %s)\n", e.Key, e.Value, e.Revision, e.Owner)
+}
+
+// handleKVGet shows the current value of a key, or all kept revisions
+func handleKVGet(key string, history bool) error {
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	kv, err := scratchpad(nc)
+	if err != nil {
+		return err
+	}
+
+	if history {
+		revisions, err := kv.History(key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return fmt.Errorf("key '%s' not found", key)
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", key, err)
+		}
+		entries := make([]KVEntry, 0, len(revisions))
+		for _, r := range revisions {
+			entries = append(entries, kvEntry(r))
+		}
+		emitList("revisions", entries, map[string]interface{}{"key": key}, func() {
+			for _, e := range entries {
+				printKVEntry(e)
+			}
+		})
+		return nil
+	}
+
+	e, err := kv.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return fmt.Errorf("key '%s' not found. See what is there with: nd kv list", key)
+	} else if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	entry := kvEntry(e)
+	emit(entry, func() {
+		fmt.Println(entry.Value)
+	})
+	return nil
+}
+
+// handleKVList shows every key, optionally only those starting with prefix
+func handleKVList(prefix string) error {
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	kv, err := scratchpad(nc)
+	if err != nil {
+		return err
+	}
+
+	keys, err := kv.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return fmt.Errorf("failed to list keys: %w", err)
+	}
+	sort.Strings(keys)
+	entries := []KVEntry{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if e, err := kv.Get(key); err == nil {
+			entries = append(entries, kvEntry(e))
+		}
+	}
+
+	emitList("entries", entries, nil, func() {
+		if len(entries) == 0 {
+			fmt.Println("The scratchpad is empty. Share something with: nd kv set <key> <value>")
+			return
+		}
+		for _, e := range entries {
+			printKVEntry(e)
+		}
+	})
+	return nil
+}
+
+// handleKVWatch prints the current values of the keys matching key, which
+// may use * and > wildcards, and then every change to them. A zero timeout
+// watches until interrupted.
+func handleKVWatch(key string, timeout time.Duration) error {
+	nc, err := connect(nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	kv, err := scratchpad(nc)
+	if err != nil {
+		return err
+	}
+	watcher, err := kv.Watch(key)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", key, err)
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	// A stream has no single document to wrap, so json is written as jsonl
+	if outputFormat == outputJSON {
+		outputFormat = outputJSONL
+	}
+
+	var stop <-chan time.Time
+	if timeout > 0 {
+		stop = time.After(timeout)
+	}
+	for {
+		select {
+		case <-stop:
+			return nil
+		case e, ok := <-watcher.Updates():
+			if !ok {
+				return nil
+			}
+			// A nil entry marks the end of the current values
+			if e == nil {
+				if isText() {
+					fmt.Println("Watching for changes (Ctrl-C to stop)...")
+				}
+				continue
+			}
+			entry := kvEntry(e)
+			emit(entry, func() { printKVEntry(entry) })
+		}
+	}
+}
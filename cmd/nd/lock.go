@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// locksBucket is the key-value bucket holding the leases on resources
+const locksBucket = "LOCKS"
+
+// defaultLockTTL is how long a lease lasts unless --ttl says otherwise
+const defaultLockTTL = 10 * time.Minute
+
+// Lock is the lease an agent holds on a resource. The fencing token grows
+// with every new holder, so a resource can refuse writes from a holder
+// whose lease has since expired.
+type Lock struct {
+	Resource   string `json:"resource"`
+	Holder     string `json:"holder,omitempty"`
+	Token      uint64 `json:"token"`
+	AcquiredAt int64  `json:"acquired_at,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// expires returns when the lease runs out. It covers all of its last second.
+func (l Lock) expires() time.Time {
+	return time.Unix(l.ExpiresAt+1, 0)
+}
+
+// held reports whether the lease is still taken
+func (l Lock) held() bool {
+	return l.Holder != "" && time.Now().Before(l.expires())
+}
+
+const lockUsage = "nd lock acquire <resource> [--ttl 10m] | release <resource> | list | wait <resource> [--ttl 10m] [--timeout DURATION]"
+
+// runLock parses and runs an nd lock subcommand
+func runLock(args []string) {
+	if len(args) < 1 {
+		usageError("lock subcommand is required (acquire, release, list, wait)", lockUsage)
+	}
+	subcmd, args := args[0], args[1:]
+
+	// The resource comes first, flags after it
+	var positional []string
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		positional, args = append(positional, args[0]), args[1:]
+	}
+
+	lockCmd := newFlagSet("lock")
+	ttl := lockCmd.Duration("ttl", defaultLockTTL, "How long the lease lasts unless renewed, e.g. 10m")
+	timeout := lockCmd.Duration("timeout", 0, "Give up waiting after this long (default: until interrupted)")
+	_ = lockCmd.Parse(args)
+	if *ttl < time.Second {
+		usageError("--ttl must be at least 1s", lockUsage)
+	}
+
+	var err error
+	switch subcmd {
+	case "acquire":
+		if len(positional) != 1 {
+			usageError("resource is required", "nd lock acquire <resource> [--ttl 10m]")
+		}
+		err = handleLockAcquire(positional[0], *ttl)
+	case "release":
+		if len(positional) != 1 {
+			usageError("resource is required", "nd lock release <resource>")
+		}
+		err = handleLockRelease(positional[0])
+	case "list":
+		if len(positional) != 0 {
+			usageError("list takes no arguments", "nd lock list")
+		}
+		err = handleLockList()
+	case "wait":
+		if len(positional) != 1 {
+			usageError("resource is required", "nd lock wait <resource> [--ttl 10m] [--timeout DURATION]")
+		}
+		err = handleLockWait(positional[0], *ttl, *timeout)
+	default:
+		usageError(fmt.Sprintf("unknown lock subcommand '%s'", subcmd), lockUsage)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+// lockRequest asks the server to acquire or release the lease on a resource
+func lockRequest(nc *nats.Conn, clientID, op, resource string, ttl time.Duration) (Lock, error) {
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"op":        op,
+		"resource":  resource,
+	}
+	if op == "acquire" {
+		req["ttl_seconds"] = int(ttl.Seconds())
+	}
+
+	var result Lock
+	err := request(nc, "needy.lock", req, 5*time.Second, &result)
+	return result, err
+}
+
+// printLocked reports a lease that was taken or renewed
+func printLocked(result Lock) {
+	emit(result, func() {
+		fmt.Println(result.Message)
+		fmt.Printf("Renew it with the same command, and release it when done: nd lock release %s\n", result.Resource)
+	})
+}
+
+// handleLockAcquire takes or renews the lease on a resource, failing if
+// another agent holds it
+func handleLockAcquire(resource string, ttl time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	result, err := lockRequest(nc, clientID, "acquire", resource, ttl)
+	if err != nil {
+		return err
+	}
+	printLocked(result)
+	return nil
+}
+
+// handleLockRelease gives up the lease on a resource
+func handleLockRelease(resource string) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	result, err := lockRequest(nc, clientID, "release", resource, 0)
+	if err != nil {
+		return err
+	}
+	emit(result, func() {
+		fmt.Println(result.Message)
+	})
+	return nil
+}
+
+// lockStore opens the bucket of leases. Reads go to it directly.
+func lockStore(nc *nats.Conn) (nats.KeyValue, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock store: %w", err)
+	}
+	kv, err := js.KeyValue(locksBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock store: %w", err)
+	}
+	return kv, nil
+}
+
+// currentLock reads the lease on a resource. Keys are the encoded resource.
+func currentLock(kv nats.KeyValue, resource string) (Lock, error) {
+	lock := Lock{Resource: resource}
+	e, err := kv.Get(base64.RawURLEncoding.EncodeToString([]byte(resource)))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return lock, nil
+	} else if err != nil {
+		return lock, err
+	}
+	err = json.Unmarshal(e.Value(), &lock)
+	return lock, err
+}
+
+// handleLockList shows the resources that are locked right now
+func handleLockList() error {
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	kv, err := lockStore(nc)
+	if err != nil {
+		return err
+	}
+
+	keys, err := kv.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return fmt.Errorf("failed to list locks: %w", err)
+	}
+	locks := []Lock{}
+	for _, key := range keys {
+		e, err := kv.Get(key)
+		if err != nil {
+			continue
+		}
+		var lock Lock
+		if json.Unmarshal(e.Value(), &lock) == nil && lock.held() {
+			locks = append(locks, lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Resource < locks[j].Resource })
+
+	emitList("locks", locks, nil, func() {
+		if len(locks) == 0 {
+			fmt.Println("No resources are locked. Claim one with: nd lock acquire <resource>")
+			return
+		}
+		for _, l := range locks {
+			fmt.Printf("%s locked by %s (token %d, %s left)\n", l.Resource, l.Holder, l.Token, roughDuration(time.Until(l.expires())))
+		}
+	})
+	return nil
+}
+
+// handleLockWait takes the lease on a resource as soon as it is free. It
+// tries again whenever the lease changes or runs out. A zero timeout waits
+// until interrupted.
+func handleLockWait(resource string, ttl, timeout time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect(nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	kv, err := lockStore(nc)
+	if err != nil {
+		return err
+	}
+	// Watching before the first attempt makes sure no release is missed
+	watcher, err := kv.Watch(base64.RawURLEncoding.EncodeToString([]byte(resource)), nats.UpdatesOnly())
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", resource, err)
+	}
+	defer func() { _ = watcher.Stop() }()
+
+	var giveUp <-chan time.Time
+	if timeout > 0 {
+		giveUp = time.After(timeout)
+	}
+
+	announced := false
+	for {
+		result, err := lockRequest(nc, clientID, "acquire", resource, ttl)
+		if err == nil {
+			printLocked(result)
+			return nil
+		}
+		var se *serverError
+		if !errors.As(err, &se) || se.field == nil || se.field.Code != "locked" {
+			return err
+		}
+
+		// Wake up when the lease changes or runs out; poll if it cannot be read
+		retry := time.Second
+		lock, readErr := currentLock(kv, resource)
+		if readErr == nil && lock.held() {
+			retry = time.Until(lock.expires())
+			if !announced && isText() {
+				fmt.Fprintf(os.Stderr, "%s is locked by %s, waiting...\n", resource, lock.Holder)
+				announced = true
+			}
+		}
+
+		select {
+		case <-giveUp:
+			return withCode(exitTimeout, fmt.Errorf("%s is still locked by %s after %s. See who holds what with: nd lock list", resource, lock.Holder, timeout))
+		case <-watcher.Updates():
+		case <-time.After(retry):
+		}
+	}
+}
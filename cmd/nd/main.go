@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -57,17 +58,100 @@ func getNatsURL() string {
 }
 
 type RegistrationRequest struct {
-	AgentName string `json:"agent_name"`
-	ClientID  string `json:"client_id"`
+	AgentName string                 `json:"agent_name"`
+	ClientID  string                 `json:"client_id"`
+	Profile   map[string]interface{} `json:"profile,omitempty"`
 }
 
 type RegistrationResponse struct {
-	Success      bool   `json:"success"`
-	Message      string `json:"message"`
+	Success      bool        `json:"success"`
+	Message      string      `json:"message"`
+	IsReregister bool        `json:"is_reregister"`
+	Error        *FieldError `json:"error,omitempty"`
+}
+
+// RegistrationResult is what nd register reports
+type RegistrationResult struct {
+	AgentName    string `json:"agent_name"`
+	ClientID     string `json:"client_id"`
 	IsReregister bool   `json:"is_reregister"`
+	Message      string `json:"message"`
+}
+
+// Message is a message as delivered by the server
+type Message struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Sender    string `json:"sender"`
+	Text      string `json:"text"`
+	Data      string `json:"data,omitempty"`
+	DataRef   string `json:"data_ref,omitempty"`
+	DataSize  uint64 `json:"data_size,omitempty"`
+	NeedID    string `json:"need_id,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+	Deadline  int64  `json:"deadline,omitempty"` // Unix time a need is due
+	Parent    string `json:"parent,omitempty"`   // Need a sub-need is part of
+	Timestamp int64  `json:"timestamp"`
+
+	ContentType string       `json:"content_type,omitempty"`
+	Encoding    string       `json:"encoding,omitempty"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	Priority  string              `json:"priority,omitempty"`   // "high" or "low"; needs without one are normal
+	Skills    []string            `json:"skills,omitempty"`     // Skills a need asks for
+	RoutedTo  map[string][]string `json:"routed_to,omitempty"`  // Agents a need was routed to
+	RoutedFor []string            `json:"routed_for,omitempty"` // Your skills that routed a need to you
+	Paths     []string            `json:"paths,omitempty"`      // Path globs an intent claims
+	DependsOn []string            `json:"depends_on,omitempty"` // Needs to be solved before this one can be
+
+	Truncated bool `json:"truncated,omitempty"` // Too large to read here; only identifying fields are set
+}
+
+// SendResult is what nd send reports
+type SendResult struct {
+	ID        string   `json:"id"`
+	Type      string   `json:"type"`
+	NeedID    string   `json:"need_id,omitempty"`
+	Recipient string   `json:"recipient,omitempty"`
+	Priority  string   `json:"priority,omitempty"`
+	Deadline  int64    `json:"deadline,omitempty"`
+	Parent    string   `json:"parent,omitempty"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	Skills    []string `json:"skills,omitempty"`
+	RoutedTo  []string `json:"routed_to,omitempty"`
+	Paths     []string `json:"paths,omitempty"`
+	Message   string   `json:"message"`
+	Warning   string   `json:"warning,omitempty"` // E.g. that no other agent is online
+
+	Conflicts []PathConflict `json:"conflicts,omitempty"` // Other agents' intents claiming overlapping paths
+}
+
+// PathConflict is another agent's open intent claiming paths that overlap
+// the ones an intent claims
+type PathConflict struct {
+	Agent  string   `json:"agent"`
+	NeedID string   `json:"need_id"`
+	Paths  []string `json:"paths"`
+}
+
+// NeedOptions shape how a need is delivered, and what an intent on one claims
+type NeedOptions struct {
+	Priority string    // "high", "normal" or "low"; higher-priority needs are read first
+	Deadline time.Time // When the need is due; agents working on it are reminded
+	Skills   []string  // Only deliver to agents advertising one of these
+	Paths    []string  // Path globs an intent will touch; overlaps are reported
+
+	Parent    string   // Need this one is a sub-need of
+	DependsOn []string // Needs that must be solved before this one can be
 }
 
 func main() {
+	args, err := extractOutputFlag(os.Args)
+	if err != nil {
+		usageError(err.Error(), "nd [command] --output json|jsonl|text")
+	}
+	os.Args = args
+
 	if len(os.Args) < 2 {
 		fmt.Println("Needy (nd) - Agent Communication Client")
 		fmt.Println("Usage: nd [command]")
@@ -81,26 +165,33 @@ func main() {
 	switch command {
 	case "send":
 		if len(os.Args) < 3 {
-			fmt.Println("Error: send subcommand is required (need, intent, solution)")
-			fmt.Println("Usage: nd send [subcommand] [args]")
-			os.Exit(1)
+			usageError("send subcommand is required (need, intent, withdraw, solution, question, answer, progress, cancel, dm)", "nd send [subcommand] [args]")
 		}
 		subcmd := os.Args[2]
 
 		var message string
-		var data string
 		var needID string
+		var recipient string
 
 		// Parse flags after subcommand
-		sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
-		sendCmd.StringVar(&data, "data", "", "Payload data")
+		sendCmd := newFlagSet("send")
+		payloadFlags := addPayloadFlags(sendCmd)
+		gitDiff := sendCmd.Bool("git-diff", false, "Send the uncommitted changes of this checkout as a patch (solution only)")
+		var skills stringList
+		sendCmd.Var(&skills, "skill", "Only deliver the need to agents with this skill (repeatable; need only)")
+		priority := sendCmd.String("priority", "", "How urgent the need is: high, normal or low (need only)")
+		deadline := sendCmd.String("deadline", "", "When the need is due, as a duration (20m) or an RFC 3339 time (need only)")
+		parent := sendCmd.String("parent", "", "Make the need a sub-need of this need (need only)")
+		var dependsOn stringList
+		sendCmd.Var(&dependsOn, "depends-on", "Comma-separated needs that must be solved before this one can be (repeatable; need only)")
+		var paths stringList
+		sendCmd.Var(&paths, "paths", "Comma-separated path globs you will touch, e.g. 'cmd/nd/**' (repeatable; intent only)")
 
 		// Parse based on subcommand
 		switch subcmd {
 		case "need":
 			if len(os.Args) < 4 {
-				fmt.Println("Error: message is required")
-				os.Exit(1)
+				usageError("message is required", "nd send need \"<message>\" [--data <payload>]")
 			}
 			message = os.Args[3]
 			// Parse flags starting from arg 4
@@ -108,18 +199,16 @@ func main() {
 				_ = sendCmd.Parse(os.Args[4:])
 			}
 		case "intent":
-			if len(os.Args) < 4 {
-				fmt.Println("Error: need ID is required")
-				os.Exit(1)
+			if len(os.Args) < 4 || strings.HasPrefix(os.Args[3], "-") {
+				flagUsageError(sendCmd, os.Args[3:], "need ID is required", "nd send intent <need-id> [--paths 'cmd/nd/**']")
 			}
 			needID = os.Args[3]
 			if len(os.Args) > 4 {
 				_ = sendCmd.Parse(os.Args[4:])
 			}
-		case "solution":
-			if len(os.Args) < 4 {
-				fmt.Println("Error: need ID is required")
-				os.Exit(1)
+		case "solution", "withdraw", "cancel":
+			if len(os.Args) < 4 || strings.HasPrefix(os.Args[3], "-") {
+				flagUsageError(sendCmd, os.Args[3:], "need ID is required", fmt.Sprintf("nd send %s <need-id> [\"<message>\"] [--data <payload>]", subcmd))
 			}
 			needID = os.Args[3]
 			// Check if arg 4 is a message or a flag
@@ -131,201 +220,731 @@ func main() {
 			if len(os.Args) > nextArgIdx {
 				_ = sendCmd.Parse(os.Args[nextArgIdx:])
 			}
+		case "question", "answer", "progress":
+			if len(os.Args) < 5 || strings.HasPrefix(os.Args[3], "-") {
+				flagUsageError(sendCmd, os.Args[3:], "need ID and message are required", fmt.Sprintf("nd send %s <need-id> \"<message>\" [--data <payload>]", subcmd))
+			}
+			needID = os.Args[3]
+			message = os.Args[4]
+			if len(os.Args) > 5 {
+				_ = sendCmd.Parse(os.Args[5:])
+			}
+		case "dm":
+			if len(os.Args) < 5 || strings.HasPrefix(os.Args[3], "-") {
+				flagUsageError(sendCmd, os.Args[3:], "recipient and message are required", "nd send dm <agent> \"<message>\" [--data <payload>]")
+			}
+			recipient = os.Args[3]
+			message = os.Args[4]
+			if len(os.Args) > 5 {
+				_ = sendCmd.Parse(os.Args[5:])
+			}
 		default:
-			fmt.Printf("Error: unknown send subcommand '%s'\n", subcmd)
-			os.Exit(1)
+			usageError(fmt.Sprintf("unknown send subcommand '%s'", subcmd), "nd send [need|intent|withdraw|solution|question|answer|progress|cancel|dm] [args]")
 		}
 
-		err := handleSend(subcmd, message, needID, data)
+		payload, err := payloadFlags.payload()
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+			usageError(err.Error(), "nd send [subcommand] [args] [--data <payload> | --data - | --data-file <path>] [--attach <path>]...")
 		}
-	case "register":
-		// Parse --name flag
-		var agentName string
-		for i := 2; i < len(os.Args); i++ {
-			if os.Args[i] == "--name" && i+1 < len(os.Args) {
-				agentName = os.Args[i+1]
-				break
+		if *gitDiff {
+			if subcmd != "solution" {
+				usageError("--git-diff is only for solutions", "nd send solution <need-id> [\"<message>\"] --git-diff")
 			}
+			if payload.Data != "" {
+				usageError("--git-diff cannot be combined with --data or --data-file", "nd send solution <need-id> [\"<message>\"] --git-diff")
+			}
+			if payload.Data, err = workingTreeDiff(); err != nil {
+				fail(err)
+			}
+			payload.ContentType = patchContentType
 		}
 
-		if agentName == "" {
-			fmt.Println("Error: --name flag is required")
-			fmt.Println("Usage: nd register --name [name]")
-			os.Exit(1)
+		if len(skills) > 0 && subcmd != "need" {
+			usageError("--skill is only for needs", "nd send need \"<message>\" --skill <skill>")
 		}
-
-		// Get or create client ID
-		clientID, _, err := getOrCreateClientID()
-		if err != nil {
-			fmt.Printf("Error: Failed to manage client identity: %v\n", err)
-			os.Exit(1)
+		if *priority != "" && subcmd != "need" {
+			usageError("--priority is only for needs", "nd send need \"<message>\" --priority high|normal|low")
 		}
 
-		// Connect to NATS
-		nc, err := nats.Connect(getNatsURL(), nats.Timeout(5*time.Second))
-		if err != nil {
-			fmt.Println("Error: Could not connect to network")
-			fmt.Printf("(Details: %v)\n", err)
-			os.Exit(1)
+		if len(paths) > 0 && subcmd != "intent" {
+			usageError("--paths is only for intents", "nd send intent <need-id> --paths 'cmd/nd/**'")
 		}
-		defer nc.Close()
 
-		// Send registration request
-		req := RegistrationRequest{
-			AgentName: agentName,
-			ClientID:  clientID,
+		if (*parent != "" || len(dependsOn) > 0) && subcmd != "need" {
+			usageError("--parent and --depends-on are only for needs", "nd send need \"<message>\" --parent <need-id> --depends-on <need-id>")
 		}
-		reqData, _ := json.Marshal(req)
 
-		msg, err := nc.Request(registrationSubj, reqData, 5*time.Second)
-		if err != nil {
-			fmt.Println("Error: Registration request timed out")
-			os.Exit(1)
+		opts := NeedOptions{Priority: *priority, Skills: skills, Parent: *parent}
+		for _, p := range paths {
+			opts.Paths = append(opts.Paths, splitList(p)...)
+		}
+		for _, d := range dependsOn {
+			opts.DependsOn = append(opts.DependsOn, splitList(d)...)
+		}
+		if *deadline != "" {
+			if subcmd != "need" {
+				usageError("--deadline is only for needs", "nd send need \"<message>\" --deadline 20m")
+			}
+			if opts.Deadline, err = parseDeadline(*deadline, time.Now()); err != nil {
+				usageError(err.Error(), "nd send need \"<message>\" --deadline 20m")
+			}
 		}
 
-		// Parse response
-		var resp RegistrationResponse
-		if err := json.Unmarshal(msg.Data, &resp); err != nil {
-			fmt.Printf("Error: Invalid response from server: %v\n", err)
-			os.Exit(1)
+		if err := handleSend(subcmd, message, needID, recipient, payload, opts); err != nil {
+			fail(err)
+		}
+	case "register":
+		registerCmd := newFlagSet("register")
+		agentName := registerCmd.String("name", "", "Name other agents will know you by")
+		profileFlags := addProfileFlags(registerCmd)
+		if len(os.Args) > 2 {
+			_ = registerCmd.Parse(os.Args[2:])
 		}
 
-		if !resp.Success {
-			fmt.Println(resp.Message)
-			os.Exit(1)
+		if *agentName == "" {
+			usageError("--name flag is required", "nd register --name [name] [--describe \"...\"] [--skill <skill>]...")
 		}
 
-		// Success!
-		fmt.Println(resp.Message)
-		fmt.Println("\nHow it works:")
-		fmt.Println("  You communicate by sending and receiving messages.")
-		fmt.Println("  Start by checking for messages from other agents, or broadcast a need.")
-		fmt.Println("\nCommands:")
-		fmt.Println("  nd send need \"<message>\"       Broadcast a need to all agents")
-		fmt.Println("  nd receive                     Read your unread messages")
+		if err := handleRegister(*agentName, profileFlags.update()); err != nil {
+			fail(err)
+		}
 	case "receive":
-		receiveCmd := flag.NewFlagSet("receive", flag.ExitOnError)
+		receiveCmd := newFlagSet("receive")
 		timeout := receiveCmd.Duration("timeout", 0, "Wait timeout")
+		maxMsgs := receiveCmd.Int("max", 0, "Maximum number of messages to read (server default 10)")
+		all := receiveCmd.Bool("all", false, "Read every waiting message")
+		peek := receiveCmd.Bool("peek", false, "Show unread messages without marking them as read")
 		if len(os.Args) > 2 {
 			_ = receiveCmd.Parse(os.Args[2:])
 		}
+		maxSet := false
+		receiveCmd.Visit(func(f *flag.Flag) { maxSet = maxSet || f.Name == "max" })
+		if *maxMsgs < 0 || maxSet && *maxMsgs == 0 {
+			usageError("--max must be a positive number", "nd receive [--max N | --all] [--peek] [--timeout DURATION]")
+		}
+		if *all && *peek {
+			usageError("--all cannot be combined with --peek; use --max to peek further ahead", "nd receive --peek [--max N]")
+		}
 
-		err := handleReceive(*timeout)
+		if err := handleReceive(*timeout, *maxMsgs, *all, *peek); err != nil {
+			fail(err)
+		}
+
+	case "watch":
+		watchCmd := newFlagSet("watch")
+		timeout := watchCmd.Duration("timeout", 0, "Stop watching after this long (default: until interrupted)")
+		if len(os.Args) > 2 {
+			_ = watchCmd.Parse(os.Args[2:])
+		}
+
+		if err := handleWatch(*timeout); err != nil {
+			fail(err)
+		}
+
+	case "rewind":
+		rewindCmd := newFlagSet("rewind")
+		to := rewindCmd.Uint64("to", 0, "Message ID to restart delivery from")
+		since := rewindCmd.Duration("since", 0, "Restart delivery from messages sent within this duration, e.g. 1h")
+		if len(os.Args) > 2 {
+			_ = rewindCmd.Parse(os.Args[2:])
+		}
+		if (*to == 0) == (*since == 0) {
+			usageError("exactly one of --to or --since is required", "nd rewind --to <message-id> | --since <duration>")
+		}
+
+		if err := handleRewind(*to, *since); err != nil {
+			fail(err)
+		}
+
+	case "ask":
+		askCmd := newFlagSet("ask")
+		payloadFlags := addPayloadFlags(askCmd)
+		timeout := askCmd.Duration("timeout", 0, "Give up after this long (default: wait until interrupted)")
+		var skills stringList
+		askCmd.Var(&skills, "skill", "Only deliver the need to agents with this skill (repeatable)")
+		priority := askCmd.String("priority", "", "How urgent the need is: high, normal or low")
+		deadline := askCmd.String("deadline", "", "When the need is due, as a duration (20m) or an RFC 3339 time")
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			flagUsageError(askCmd, os.Args[2:], "message is required", "nd ask \"<message>\" [--data <payload>] [--timeout DURATION]")
+		}
+		if len(os.Args) > 3 {
+			_ = askCmd.Parse(os.Args[3:])
+		}
+
+		payload, err := payloadFlags.payload()
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+			usageError(err.Error(), "nd ask \"<message>\" [--data <payload> | --data - | --data-file <path>] [--attach <path>]...")
+		}
+
+		opts := NeedOptions{Priority: *priority, Skills: skills}
+		if *deadline != "" {
+			if opts.Deadline, err = parseDeadline(*deadline, time.Now()); err != nil {
+				usageError(err.Error(), "nd ask \"<message>\" --deadline 20m")
+			}
+		}
+
+		if err := handleAsk(os.Args[2], payload, opts, *timeout); err != nil {
+			fail(err)
+		}
+
+	case "serve":
+		serveCmd := newFlagSet("serve")
+		match := serveCmd.String("match", "", "Only handle needs matching this regular expression, or tagged #tag")
+		command := serveCmd.String("exec", "", "Handler command; gets the need payload on stdin, prints the solution")
+		concurrency := serveCmd.Int("concurrency", 1, "Maximum number of handlers running at once")
+		timeout := serveCmd.Duration("timeout", 0, "Stop serving after this long (default: until interrupted)")
+		if len(os.Args) > 2 {
+			_ = serveCmd.Parse(os.Args[2:])
+		}
+		if *command == "" {
+			usageError("--exec is required", "nd serve --exec ./handler.sh [--match <regex|#tag>] [--concurrency N]")
+		}
+		if *concurrency < 1 {
+			usageError("--concurrency must be at least 1", "nd serve --exec ./handler.sh [--concurrency N]")
+		}
+
+		if err := handleServe(*match, *command, *concurrency, *timeout); err != nil {
+			fail(err)
+		}
+
+	case "subscribe":
+		subscribeCmd := newFlagSet("subscribe")
+		types := subscribeCmd.String("types", "", "Comma-separated message types to deliver (need, intent, withdraw, solution, question, answer, progress, cancel, dm, reminder, overdue, conflict)")
+		mine := subscribeCmd.Bool("mine", false, "Only deliver replies to your own needs")
+		if len(os.Args) > 2 {
+			_ = subscribeCmd.Parse(os.Args[2:])
+		}
+
+		if err := handleSubscribe(splitList(*types), *mine); err != nil {
+			fail(err)
 		}
 
 	case "get":
-		if len(os.Args) < 3 {
-			fmt.Println("Error: message ID is required")
-			fmt.Println("Usage: nd get [message-id]")
-			os.Exit(1)
+		getCmd := newFlagSet("get")
+		saveDir := getCmd.String("save-dir", "", "Write the message's attachments to this directory")
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			flagUsageError(getCmd, os.Args[2:], "message ID is required", "nd get [message-id] [--save-dir <dir>]")
 		}
 		msgID := os.Args[2]
-		err := handleGet(msgID)
+		if len(os.Args) > 3 {
+			_ = getCmd.Parse(os.Args[3:])
+		}
+		if err := handleGet(msgID, *saveDir); err != nil {
+			fail(err)
+		}
+
+	case "profile":
+		if len(os.Args) < 3 || os.Args[2] != "set" {
+			usageError("profile subcommand is required (set)", "nd profile set [--describe \"...\"] [--skill <skill>]... [--model <model>] [--repo <repo>]")
+		}
+		profileCmd := newFlagSet("profile")
+		profileFlags := addProfileFlags(profileCmd)
+		if len(os.Args) > 3 {
+			_ = profileCmd.Parse(os.Args[3:])
+		}
+		update := profileFlags.update()
+		if update == nil {
+			usageError("nothing to set", "nd profile set [--describe \"...\"] [--skill <skill>]... [--model <model>] [--repo <repo>]")
+		}
+		if err := handleProfileSet(update); err != nil {
+			fail(err)
+		}
+
+	case "agents":
+		agentsCmd := newFlagSet("agents")
+		skill := agentsCmd.String("skill", "", "Only list agents advertising this skill")
+		if len(os.Args) > 2 {
+			_ = agentsCmd.Parse(os.Args[2:])
+		}
+		if err := handleAgents(*skill); err != nil {
+			fail(err)
+		}
+
+	case "apply":
+		applyCmd := newFlagSet("apply")
+		dryRun := applyCmd.Bool("dry-run", false, "Only check whether the patch applies and report conflicts")
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			flagUsageError(applyCmd, os.Args[2:], "solution ID is required", "nd apply <solution-id> [--dry-run]")
+		}
+		msgID := os.Args[2]
+		if len(os.Args) > 3 {
+			_ = applyCmd.Parse(os.Args[3:])
+		}
+		conflicts, err := handleApply(msgID, *dryRun)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+			fail(err)
+		}
+		if conflicts {
+			os.Exit(exitConflict)
+		}
+
+	case "thread":
+		threadCmd := newFlagSet("thread")
+		limit := threadCmd.Int("max", 0, "Number of most recent replies to show (server default 50)")
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			flagUsageError(threadCmd, os.Args[2:], "need ID is required", "nd thread <need-id> [--max N]")
+		}
+		_ = threadCmd.Parse(os.Args[3:])
+		limitSet := false
+		threadCmd.Visit(func(f *flag.Flag) { limitSet = limitSet || f.Name == "max" })
+		if *limit < 0 || limitSet && *limit == 0 {
+			usageError("--max must be a positive number", "nd thread <need-id> [--max N]")
+		}
+		if err := handleThread(os.Args[2], *limit); err != nil {
+			fail(err)
+		}
+
+	case "kv":
+		runKV(os.Args[2:])
+
+	case "lock":
+		runLock(os.Args[2:])
+
+	case "heartbeat":
+		heartbeatCmd := newFlagSet("heartbeat")
+		every := heartbeatCmd.Duration("every", 0, "Keep sending heartbeats at this interval until interrupted, e.g. 1m")
+		if len(os.Args) > 2 {
+			_ = heartbeatCmd.Parse(os.Args[2:])
+		}
+		if *every < 0 {
+			usageError("--every must be positive", "nd heartbeat [--every DURATION]")
+		}
+
+		if err := handleHeartbeat(*every); err != nil {
+			fail(err)
+		}
+
+	case "needs":
+		needsCmd := newFlagSet("needs")
+		limit := needsCmd.Int("max", 0, "Number of most pressing needs to list (server default 20)")
+		_ = needsCmd.Parse(os.Args[2:])
+		limitSet := false
+		needsCmd.Visit(func(f *flag.Flag) { limitSet = limitSet || f.Name == "max" })
+		if *limit < 0 || limitSet && *limit == 0 {
+			usageError("--max must be a positive number", "nd needs [--max N]")
+		}
+		if err := handleNeeds(*limit); err != nil {
+			fail(err)
+		}
+
+	case "history":
+		historyCmd := newFlagSet("history")
+		limit := historyCmd.Int("max", 0, "Number of most recent messages to list (server default 20)")
+		_ = historyCmd.Parse(os.Args[2:])
+		limitSet := false
+		historyCmd.Visit(func(f *flag.Flag) { limitSet = limitSet || f.Name == "max" })
+		if *limit < 0 || limitSet && *limit == 0 {
+			usageError("--max must be a positive number", "nd history [--max N]")
+		}
+		if err := handleHistory(*limit); err != nil {
+			fail(err)
 		}
 
 	case "help", "--help", "-h":
 		fmt.Println("Needy (nd) - Agent Communication Client")
-		fmt.Println("Usage: nd [command]")
+		fmt.Println("Usage: nd [command] [--output json|jsonl|text]")
 		fmt.Println("\nCommands:")
-		fmt.Println("  register  Register on the network (Usage: nd register --name [name])")
-		fmt.Println("  send      Send a message (need, intent, or solution)")
+		fmt.Println("  register  Register on the network (Usage: nd register --name [name] [--describe \"...\"] [--skill go])")
+		fmt.Println("  profile   Describe yourself to other agents (nd profile set --describe \"...\" --skill go)")
+		fmt.Println("  agents    List registered agents, whether they are online and what they are good at (--skill go)")
+		fmt.Println("  heartbeat Tell the network you are still around (--every 1m to keep it up)")
+		fmt.Println("  send      Send a message (need, intent, withdraw, solution, question, answer, progress, cancel, or dm <agent>)")
+		fmt.Println("  ask       Send a need and wait for its solution (--timeout 30m)")
+		fmt.Println("  serve     Handle matching needs with a command (--match '#tag' --exec ./handler.sh)")
 		fmt.Println("  receive   Read your unread messages")
+		fmt.Println("  watch     Stream new messages as they arrive")
+		fmt.Println("  rewind    Replay messages you have already read (--to <id> or --since 1h)")
+		fmt.Println("  subscribe Choose which messages reach your mailbox (--types need --mine)")
 		fmt.Println("  get       Retrieve the full payload of a message")
+		fmt.Println("  thread    Show a need with the messages that reference it (--max N)")
+		fmt.Println("  kv        Share state on the scratchpad (set, get, list, watch, delete)")
+		fmt.Println("  lock      Claim files or resources before changing them (acquire, release, list, wait)")
+		fmt.Println("  needs     List the needs that have no solution yet, most urgent deadline first (--max N)")
+		fmt.Println("  history   List the messages you have sent, direct messages included (--max N)")
+		fmt.Println("  apply     Apply a solution's patch to this checkout (--dry-run to check first)")
 		fmt.Println("\nRegistration is required before using other commands.")
+		fmt.Println("\nOutput:")
+		fmt.Println("  --output json   One JSON document per command (errors as {\"error\": ..., \"exit_code\": ...})")
+		fmt.Println("  --output jsonl  One JSON record per line, suitable for streaming")
+		fmt.Println("  --output text   Human-readable output with hints (default)")
+		fmt.Println("\nExit codes: 0 ok, 1 error, 2 usage, 3 network unavailable, 4 timeout, 5 conflict, 130 interrupted")
 	default:
-		fmt.Printf("Unknown command: %s\n", command)
+		usageError(fmt.Sprintf("unknown command: %s", command), "nd help")
+	}
+}
+
+// flagUsageError parses args as the command's flags, so that --output
+// applies to the error, and reports an invalid command line
+func flagUsageError(fs *flag.FlagSet, args []string, message, usage string) {
+	_ = fs.Parse(args)
+	usageError(message, usage)
+}
+
+// connect opens a connection to the local network
+func connect(opts ...nats.Option) (*nats.Conn, error) {
+	opts = append([]nats.Option{nats.Timeout(5 * time.Second)}, opts...)
+	nc, err := nats.Connect(getNatsURL(), opts...)
+	if err != nil {
+		return nil, withCode(exitUnavailable, fmt.Errorf("could not connect to network: %w", err))
+	}
+	return nc, nil
+}
+
+// request sends req to subj and decodes a successful response into resp.
+// A response with success=false is returned as a serverError carrying its
+// message and, for a rejected field, which field it was.
+func request(nc *nats.Conn, subj string, req interface{}, timeout time.Duration, resp interface{}) error {
+	reqData, _ := json.Marshal(req)
+
+	respMsg, err := nc.Request(subj, reqData, timeout)
+	if err != nil {
+		err = fmt.Errorf("%s request failed: %w", strings.TrimPrefix(subj, "needy."), err)
+		if errors.Is(err, nats.ErrTimeout) {
+			return withCode(exitTimeout, err)
+		}
+		return withCode(exitUnavailable, err)
+	}
+
+	var status struct {
+		Success bool            `json:"success"`
+		Message json.RawMessage `json:"message"`
+		Error   *FieldError     `json:"error"`
+	}
+	if err := json.Unmarshal(respMsg.Data, &status); err != nil {
+		return fmt.Errorf("invalid server response: %w", err)
+	}
+	if !status.Success {
+		var errMsg string
+		_ = json.Unmarshal(status.Message, &errMsg)
+		return &serverError{message: errMsg, field: status.Error}
 	}
+
+	if resp == nil {
+		return nil
+	}
+	if err := json.Unmarshal(respMsg.Data, resp); err != nil {
+		return fmt.Errorf("invalid server response: %w", err)
+	}
+	return nil
 }
 
-func handleSend(msgType, text, relatedID, data string) error {
+func handleRegister(agentName string, profile map[string]interface{}) error {
+	// Get or create client ID
 	clientID, _, err := getOrCreateClientID()
 	if err != nil {
-		return fmt.Errorf("failed to get client ID: %w", err)
+		return fmt.Errorf("failed to manage client identity: %w", err)
+	}
+
+	// Connect to NATS
+	nc, err := connect()
+	if err != nil {
+		if isText() {
+			fmt.Println("Error: Could not connect to network")
+			fmt.Printf("(Details: %v)\n", errors.Unwrap(err))
+			os.Exit(exitUnavailable)
+		}
+		return err
+	}
+	defer nc.Close()
+
+	// Send registration request
+	req := RegistrationRequest{
+		AgentName: agentName,
+		ClientID:  clientID,
+		Profile:   profile,
 	}
+	reqData, _ := json.Marshal(req)
 
-	// Basic validation
-	if len(text) > 100 {
-		return fmt.Errorf("message too long (max 100 chars). Use a short message and put details in --data, e.g.: nd send %s \"<short message>\" --data \"<full details>\"", msgType)
+	msg, err := nc.Request(registrationSubj, reqData, 5*time.Second)
+	if err != nil {
+		return withCode(exitTimeout, fmt.Errorf("registration request timed out"))
 	}
-	if len(relatedID) > 50 {
-		if msgType == "intent" {
-			return fmt.Errorf("intent need ID too long (max 50 chars). Intents should be short - just reference the need ID, e.g.: nd send intent <need-id>")
+
+	// Parse response
+	var resp RegistrationResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("invalid response from server: %w", err)
+	}
+
+	if !resp.Success {
+		return &serverError{message: strings.TrimPrefix(resp.Message, "Error: "), field: resp.Error}
+	}
+
+	// Success! Remember the name so commands can recognise our own messages
+	cfg := readConfig()
+	cfg["name"] = agentName
+	if err := writeConfig(cfg); err != nil {
+		return fmt.Errorf("failed to save agent name: %w", err)
+	}
+
+	result := RegistrationResult{
+		AgentName:    agentName,
+		ClientID:     clientID,
+		IsReregister: resp.IsReregister,
+		Message:      resp.Message,
+	}
+	emit(result, func() {
+		fmt.Println(resp.Message)
+		fmt.Println("\nHow it works:")
+		fmt.Println("  You communicate by sending and receiving messages.")
+		fmt.Println("  Start by checking for messages from other agents, or broadcast a need.")
+		fmt.Println("\nCommands:")
+		fmt.Println("  nd send need \"<message>\"       Broadcast a need to all agents")
+		fmt.Println("  nd receive                     Read your unread messages")
+		fmt.Println("  nd agents                      See who else is here and what they do")
+		if profile == nil {
+			fmt.Println("\nTell others what you are good at: nd profile set --describe \"...\" --skill <skill>")
 		}
-		return fmt.Errorf("need ID too long (max 50 chars)")
+	})
+	return nil
+}
+
+func handleSend(msgType, text, relatedID, recipient string, payload Payload, opts NeedOptions) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
 	}
 
-	nc, err := nats.Connect(getNatsURL(), nats.Timeout(5*time.Second))
+	nc, err := connect()
 	if err != nil {
-		return fmt.Errorf("could not connect to network: %w", err)
+		return err
 	}
 	defer nc.Close()
 
+	result, err := postMessage(nc, clientID, msgType, text, relatedID, recipient, payload, opts)
+	if err != nil {
+		return err
+	}
+
+	emit(result, func() {
+		fmt.Println(result.Message)
+		printRouting(result)
+		if result.Warning != "" {
+			fmt.Printf("Warning: %s\n", result.Warning)
+		}
+		for _, c := range result.Conflicts {
+			fmt.Printf("Warning: %s is working on %s for need %s. Coordinate with: nd send dm %s \"<message>\"\n", c.Agent, strings.Join(c.Paths, ", "), c.NeedID, c.Agent)
+		}
+		if result.Deadline > 0 {
+			fmt.Printf("Due at %s. Agents with intent on it will be reminded, and you will be told if it passes unsolved.\n", time.Unix(result.Deadline, 0).Format("2006-01-02 15:04:05"))
+		}
+
+		if len(result.DependsOn) > 0 {
+			fmt.Printf("It can only be solved once need(s) %s are.\n", strings.Join(result.DependsOn, ", "))
+		}
+		if result.Parent != "" {
+			fmt.Printf("\nSee how need %s is getting on with: nd thread %s\n", result.Parent, result.Parent)
+		}
+
+		if msgType == "intent" {
+			fmt.Printf("\nYou can now offer a solution: nd send solution %s --data \"<payload>\"\n", relatedID)
+		}
+		if msgType == "question" {
+			fmt.Printf("\nThe owner of need %s will reply with an answer. Check for it with: nd receive --timeout 180s\n", relatedID)
+		}
+		if msgType == "dm" {
+			fmt.Printf("\nOnly %s can read it. Look it up again with: nd get %s\n", recipient, result.ID)
+		}
+	})
+
+	return nil
+}
+
+// postMessage asks the server to publish a message and reports what was sent
+func postMessage(nc *nats.Conn, clientID, msgType, text, relatedID, recipient string, payload Payload, opts NeedOptions) (SendResult, error) {
 	// Construct message payload
 	msg := map[string]interface{}{
 		"type":      msgType,
 		"client_id": clientID,
 		"text":      text,
-		"data":      data,
 		"timestamp": time.Now().Unix(),
 	}
+	if payload.ContentType != "" {
+		msg["content_type"] = payload.ContentType
+	}
 
 	switch msgType {
-	case "intent", "solution":
+	case "intent", "withdraw", "solution", "question", "answer", "progress", "cancel":
 		msg["need_id"] = relatedID
+	case "dm":
+		msg["recipient"] = recipient
+	}
+	if opts.Priority != "" {
+		msg["priority"] = opts.Priority
+	}
+	if !opts.Deadline.IsZero() {
+		msg["deadline"] = opts.Deadline.Unix()
+	}
+	if len(opts.Skills) > 0 {
+		msg["skills"] = opts.Skills
+	}
+	if len(opts.Paths) > 0 {
+		msg["paths"] = opts.Paths
+	}
+	if opts.Parent != "" {
+		msg["parent"] = opts.Parent
+	}
+	if len(opts.DependsOn) > 0 {
+		msg["depends_on"] = opts.DependsOn
 	}
 
-	reqData, _ := json.Marshal(msg)
+	// Payloads too large for a request and attachments go to the object
+	// store first, once they are known to be within the server's limit.
+	// Binary data sent inline is base64 encoded.
+	data, encoding := encodeData(payload.Data)
+	inline := fitsInRequest(nc, data)
+	if !inline || len(payload.Attachments) > 0 {
+		if err := checkPayloadSize(nc, payload.Data, payload.Attachments); err != nil {
+			return SendResult{}, err
+		}
+	}
+	var uploaded []string
+	if inline {
+		msg["data"] = data
+		if encoding != "" {
+			msg["encoding"] = encoding
+		}
+	} else {
+		ref, err := uploadPayload(nc, strings.NewReader(payload.Data))
+		if err != nil {
+			return SendResult{}, err
+		}
+		uploaded = append(uploaded, ref)
+		msg["data"] = ""
+		msg["data_ref"] = ref
+	}
+	if len(payload.Attachments) > 0 {
+		attachments, err := uploadAttachments(nc, payload.Attachments)
+		if err != nil {
+			discardUploads(nc, uploaded)
+			return SendResult{}, err
+		}
+		for _, a := range attachments {
+			uploaded = append(uploaded, a.Ref)
+		}
+		msg["attachments"] = attachments
+	}
 
 	// We use a request-reply to ensure the server accepted it
-	respMsg, err := nc.Request("needy.send", reqData, 5*time.Second)
-	if err != nil {
-		return fmt.Errorf("send request failed: %w", err)
+	var resp struct {
+		ID        string         `json:"id"`
+		Message   string         `json:"message"`
+		RoutedTo  []string       `json:"routed_to"`
+		Warning   string         `json:"warning"`
+		Conflicts []PathConflict `json:"conflicts"`
 	}
-
-	var resp map[string]interface{}
-	if err := json.Unmarshal(respMsg.Data, &resp); err != nil {
-		return fmt.Errorf("invalid server response: %w", err)
+	if err := request(nc, "needy.send", msg, 5*time.Second, &resp); err != nil {
+		// A refused message leaves nothing to reference the uploads. After a
+		// timeout the message may still have been stored, so they stay.
+		var se *serverError
+		if errors.As(err, &se) {
+			discardUploads(nc, uploaded)
+		}
+		return SendResult{}, err
 	}
 
-	if success, ok := resp["success"].(bool); !ok || !success {
-		errMsg, _ := resp["message"].(string)
-		return fmt.Errorf("%s", errMsg)
+	result := SendResult{
+		ID:        resp.ID,
+		Type:      msgType,
+		NeedID:    relatedID,
+		Recipient: recipient,
+		Priority:  opts.Priority,
+		Skills:    opts.Skills,
+		RoutedTo:  resp.RoutedTo,
+		Paths:     opts.Paths,
+		Parent:    opts.Parent,
+		DependsOn: opts.DependsOn,
+		Message:   resp.Message,
+		Warning:   resp.Warning,
+		Conflicts: resp.Conflicts,
 	}
-
-	msgVal, _ := resp["message"].(string)
-	fmt.Println(msgVal)
-
-	if msgType == "intent" {
-		fmt.Printf("\nYou can now offer a solution: nd send solution %s --data \"<payload>\"\n", relatedID)
+	if !opts.Deadline.IsZero() {
+		result.Deadline = opts.Deadline.Unix()
 	}
-
-	return nil
+	return result, nil
 }
 
-func handleReceive(timeout time.Duration) error {
+func handleReceive(timeout time.Duration, maxMsgs int, all, peek bool) error {
 	clientID, _, err := getOrCreateClientID()
 	if err != nil {
 		return fmt.Errorf("failed to get client ID: %w", err)
 	}
 
-	nc, err := nats.Connect(getNatsURL(), nats.Timeout(5*time.Second))
+	nc, err := connect()
 	if err != nil {
-		return fmt.Errorf("could not connect to network: %w", err)
+		return err
 	}
 	defer nc.Close()
 
+	msgs, pending, err := readMailbox(nc, clientID, timeout, maxMsgs, peek)
+	if err != nil {
+		if exitCodeFor(err) != exitTimeout || timeout == 0 {
+			return err
+		}
+		// A timeout is expected if no messages came
+		msgs = []Message{}
+	}
+
+	// With --all, keep draining without waiting until the mailbox is empty
+	for all && pending > 0 {
+		more, left, err := readMailbox(nc, clientID, 0, maxMsgs, false)
+		if err != nil {
+			return err
+		}
+		if len(more) == 0 {
+			break
+		}
+		msgs = append(msgs, more...)
+		pending = left
+	}
+
+	extra := map[string]interface{}{"pending": pending}
+	emitList("messages", msgs, extra, func() {
+		types := printMessages(msgs)
+
+		if types["need"] {
+			fmt.Println("\nIf this is something you are equipped to respond to, first announce your intent: nd send intent <need-id>")
+		}
+		if types["question"] {
+			fmt.Println("To answer a question about your need: nd send answer <need-id> \"<answer>\"")
+		}
+		if len(msgs) > 0 {
+			fmt.Println("Use \"nd get <id>\" to retrieve the full payload of the message.")
+		}
+		if peek && len(msgs) > 0 {
+			fmt.Println("(Peek only: these messages are still unread.)")
+		}
+
+		if pending > 0 {
+			fmt.Printf("%d more message(s) waiting. Use --max N or --all to read more.\n", pending)
+		}
+
+		if len(msgs) == 0 {
+			if timeout > 0 {
+				fmt.Println("No new messages.")
+			} else {
+				fmt.Println("No new messages. Use --timeout to wait, e.g.: nd receive --timeout 180s")
+			}
+		}
+	})
+
+	return nil
+}
+
+// readMailbox asks the server for up to maxMsgs of the next unread messages
+// (0 for the server default), letting it wait up to timeout for new ones to
+// arrive. A peek leaves the messages unread. It also returns how many
+// messages are left in the mailbox.
+func readMailbox(nc *nats.Conn, clientID string, timeout time.Duration, maxMsgs int, peek bool) ([]Message, uint64, error) {
 	req := map[string]interface{}{
 		"client_id": clientID,
 	}
+	if peek {
+		req["peek"] = true
+	}
+	if maxMsgs > 0 {
+		req["max"] = maxMsgs
+	}
 
 	// Since receive might wait, we should allow a longer timeout if requested
 	waitDuration := 2 * time.Second
@@ -335,78 +954,83 @@ func handleReceive(timeout time.Duration) error {
 		// We also need to tell the server how long to wait
 		req["timeout_ms"] = timeout.Milliseconds()
 	}
-	reqData, _ := json.Marshal(req)
 
-	respMsg, err := nc.Request("needy.read", reqData, waitDuration)
-	if err != nil {
-		if err == nats.ErrTimeout && timeout > 0 {
-			// This might be expected if no messages came
-			return nil
-		}
-		return fmt.Errorf("receive request failed: %w", err)
+	var resp struct {
+		Messages []Message `json:"messages"`
+		Pending  uint64    `json:"pending"`
 	}
-
-	var resp map[string]interface{}
-	if err := json.Unmarshal(respMsg.Data, &resp); err != nil {
-		return fmt.Errorf("invalid server response: %w", err)
+	if err := request(nc, "needy.read", req, waitDuration, &resp); err != nil {
+		return nil, 0, err
 	}
+	if resp.Messages == nil {
+		resp.Messages = []Message{}
+	}
+	return resp.Messages, resp.Pending, nil
+}
 
-	if success, ok := resp["success"].(bool); !ok || !success {
-		errMsg, _ := resp["message"].(string)
-		return fmt.Errorf("%s", errMsg)
+// printRouting says who a need asking for skills was delivered to
+func printRouting(result SendResult) {
+	if len(result.Skills) == 0 {
+		return
 	}
+	if len(result.RoutedTo) == 0 {
+		fmt.Printf("No other agent advertises %s, so the need went to everyone.\n", strings.Join(result.Skills, " or "))
+		return
+	}
+	fmt.Printf("Routed to %s (skills: %s).\n", strings.Join(result.RoutedTo, ", "), strings.Join(result.Skills, ", "))
+}
 
-	// Print messages
-	msgs, _ := resp["messages"].([]interface{})
-	hasNeeds := false
+// printMessages prints one line per message and reports which message types it saw
+func printMessages(msgs []Message) map[string]bool {
+	types := map[string]bool{}
 	for _, m := range msgs {
-		msgMap := m.(map[string]interface{})
-		mType := msgMap["type"].(string)
-		mSender := msgMap["sender"].(string)
-		mText := msgMap["text"].(string)
-
-		if mType == "need" {
-			hasNeeds = true
+		types[m.Type] = true
+		about := ""
+		if m.NeedID != "" {
+			about = " on need " + m.NeedID
 		}
-
-		// Message ID might be returned as float64 or string depending on JSON unmarshal
-		var mID string
-		if idVal, ok := msgMap["id"].(string); ok {
-			mID = idVal
-		} else if idNum, ok := msgMap["id"].(float64); ok {
-			mID = fmt.Sprintf("%.0f", idNum) // assuming integer ID if numeric
+		attached := ""
+		if m.Priority != "" {
+			attached = fmt.Sprintf(" (%s priority)", m.Priority)
 		}
-
-		fmt.Printf("[%s] %s from %s: %s\n", mID, strings.ToUpper(mType), mSender, mText)
-	}
-
-	if hasNeeds {
-		fmt.Println("\nIf this is something you are equipped to respond to, first announce your intent: nd send intent <need-id>")
-	}
-	if len(msgs) > 0 {
-		fmt.Println("Use \"nd get <id>\" to retrieve the full payload of the message.")
-	}
-
-	if len(msgs) == 0 {
-		if timeout > 0 {
-			fmt.Println("No new messages.")
-		} else {
-			fmt.Println("No new messages. Use --timeout to wait, e.g.: nd receive --timeout 180s")
+		if m.Type == "need" && m.Deadline > 0 {
+			attached += fmt.Sprintf(" (%s)", dueLabel(m.Deadline, time.Now()))
+		}
+		if len(m.Attachments) > 0 {
+			attached += fmt.Sprintf(" (%d attachment(s))", len(m.Attachments))
+		}
+		if m.Parent != "" {
+			attached += fmt.Sprintf(" (part of need %s)", m.Parent)
+		}
+		if len(m.DependsOn) > 0 {
+			attached += fmt.Sprintf(" (after need %s)", strings.Join(m.DependsOn, ", "))
 		}
+		if m.Type == "intent" && len(m.Paths) > 0 {
+			attached += fmt.Sprintf(" (touches %s)", strings.Join(m.Paths, ", "))
+		}
+		if len(m.RoutedFor) > 0 {
+			attached += fmt.Sprintf(" (routed to you for %s)", strings.Join(m.RoutedFor, ", "))
+		} else if len(m.Skills) > 0 {
+			attached += fmt.Sprintf(" (asks for %s)", strings.Join(m.Skills, ", "))
+		}
+		text := m.Text
+		if m.Truncated {
+			text = fmt.Sprintf("(too large to show here; read it with: nd get %s)", m.ID)
+		}
+		fmt.Printf("[%s] %s from %s%s: %s%s\n", m.ID, strings.ToUpper(m.Type), m.Sender, about, text, attached)
 	}
-
-	return nil
+	return types
 }
 
-func handleGet(msgID string) error {
+func handleGet(msgID, saveDir string) error {
 	clientID, _, err := getOrCreateClientID()
 	if err != nil {
 		return fmt.Errorf("failed to get client ID: %w", err)
 	}
 
-	nc, err := nats.Connect(getNatsURL(), nats.Timeout(5*time.Second))
+	nc, err := connect()
 	if err != nil {
-		return fmt.Errorf("could not connect to network: %w", err)
+		return err
 	}
 	defer nc.Close()
 
@@ -414,37 +1038,58 @@ func handleGet(msgID string) error {
 		"client_id": clientID,
 		"msg_id":    msgID,
 	}
-	reqData, _ := json.Marshal(req)
 
-	respMsg, err := nc.Request("needy.get", reqData, 5*time.Second)
-	if err != nil {
-		return fmt.Errorf("get request failed: %w", err)
+	var resp struct {
+		Message Message `json:"message"`
 	}
-
-	var resp map[string]interface{}
-	if err := json.Unmarshal(respMsg.Data, &resp); err != nil {
-		return fmt.Errorf("invalid server response: %w", err)
+	if err := request(nc, "needy.get", req, 5*time.Second, &resp); err != nil {
+		return err
 	}
 
-	if success, ok := resp["success"].(bool); !ok || !success {
-		errMsg, _ := resp["message"].(string)
-		return fmt.Errorf("%s", errMsg)
-	}
+	msg := resp.Message
 
-	msgObj, ok := resp["message"].(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid message format in response")
+	var saved []string
+	if saveDir != "" {
+		if saved, err = saveAttachments(nc, msg.Attachments, saveDir); err != nil {
+			return err
+		}
 	}
 
-	if data, ok := msgObj["data"].(string); ok && data != "" {
-		fmt.Println(data)
-	} else {
-		fmt.Println(msgObj["text"])
+	if isText() {
+		if err := printPayload(nc, msg); err != nil {
+			return err
+		}
+		printAttachments(msg, saved)
+		return nil
 	}
+	if err := loadPayload(nc, &msg); err != nil {
+		return err
+	}
+	emit(msg, func() {})
 
 	return nil
 }
 
+// printAttachments lists a message's attachments, or where they were saved,
+// on stderr so the payload on stdout stays clean
+func printAttachments(msg Message, saved []string) {
+	for _, path := range saved {
+		fmt.Fprintf(os.Stderr, "Saved %s\n", path)
+	}
+	if len(saved) > 0 || len(msg.Attachments) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n%d attachment(s):\n", len(msg.Attachments))
+	for _, a := range msg.Attachments {
+		if a.ContentType != "" {
+			fmt.Fprintf(os.Stderr, "  %s (%s, %d bytes)\n", a.Name, a.ContentType, a.Size)
+		} else {
+			fmt.Fprintf(os.Stderr, "  %s (%d bytes)\n", a.Name, a.Size)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Save them with: nd get %s --save-dir <dir>\n", msg.ID)
+}
+
 // getOrCreateClientID returns the client ID, whether this is a re-registration, and any error
 func getOrCreateClientID() (string, bool, error) {
 	cfg := readConfig()
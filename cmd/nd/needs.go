@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseDeadline reads a --deadline value: a duration from now, such as 20m,
+// or an RFC 3339 timestamp
+func parseDeadline(value string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("--deadline must be in the future")
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --deadline '%s' (use a duration like 20m or a time like 2026-01-02T15:04:05Z)", value)
+	}
+	if !t.After(now) {
+		return time.Time{}, fmt.Errorf("--deadline must be in the future")
+	}
+	return t, nil
+}
+
+// dueLabel says how long is left until a deadline, or how long ago it passed
+func dueLabel(deadline int64, now time.Time) string {
+	left := time.Unix(deadline, 0).Sub(now)
+	if left <= 0 {
+		return "overdue by " + roughDuration(-left)
+	}
+	return "due in " + roughDuration(left)
+}
+
+// roughDuration formats d to the second below a minute and to the minute
+// above, e.g. 45s, 12m or 1h5m
+func roughDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	s := d.Round(time.Minute).String()
+	s = strings.TrimSuffix(s, "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// handleNeeds lists the needs that have no solution yet, the most pressing
+// limit of them, or as many as the server returns by default if limit is 0
+func handleNeeds(limit int) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+	}
+	if limit > 0 {
+		req["max"] = limit
+	}
+	var resp struct {
+		Needs []Message `json:"needs"`
+		More  int       `json:"more"`
+	}
+	if err := request(nc, "needy.needs", req, 10*time.Second, &resp); err != nil {
+		return err
+	}
+	if resp.Needs == nil {
+		resp.Needs = []Message{}
+	}
+
+	emitList("needs", resp.Needs, map[string]interface{}{"more": resp.More}, func() {
+		if len(resp.Needs) == 0 {
+			fmt.Println("No open needs.")
+			return
+		}
+		printMessages(resp.Needs)
+		if resp.More > 0 {
+			fmt.Printf("\n%d more open need(s) not shown. List more with: nd needs --max %d\n", resp.More, len(resp.Needs)+resp.More)
+		}
+		fmt.Println("\nTo work on one, announce your intent: nd send intent <need-id>")
+	})
+	return nil
+}
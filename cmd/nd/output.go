@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Exit codes are part of the scripting contract and must not change meaning
+const (
+	exitOK          = 0 // Command succeeded
+	exitError       = 1 // The server rejected the request or something else went wrong
+	exitUsage       = 2 // The command line was invalid
+	exitUnavailable = 3 // The network could not be reached
+	exitTimeout     = 4 // The server did not answer in time, or a wait ran out
+	exitConflict    = 5 // A patch did not apply cleanly to the checkout
+
+	exitInterrupted = 130 // A wait was cancelled with Ctrl-C or SIGTERM
+)
+
+// Output formats selectable with --output
+const (
+	outputText  = "text"
+	outputJSON  = "json"
+	outputJSONL = "jsonl"
+)
+
+// outputFormat is the format chosen for this invocation
+var outputFormat = outputText
+
+// codedError attaches an exit code to an error
+type codedError struct {
+	code int
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+// FieldError is the server's structured reason for rejecting a request field
+type FieldError struct {
+	Code  string `json:"code"` // required, invalid_type, invalid_value, too_long or too_many
+	Field string `json:"field"`
+	Limit int    `json:"limit,omitempty"`
+}
+
+// serverError is a request the server rejected
+type serverError struct {
+	message string
+	field   *FieldError // Set when a specific field was rejected
+}
+
+func (e *serverError) Error() string { return e.message }
+
+// withCode marks err so that fail exits with the given code
+func withCode(code int, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// exitCodeFor returns the exit code carried by err, or exitError
+func exitCodeFor(err error) int {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	return exitError
+}
+
+// setOutputFormat records the format chosen with --output
+func setOutputFormat(value string) error {
+	switch value {
+	case outputText, outputJSON, outputJSONL:
+		outputFormat = value
+		return nil
+	}
+	return fmt.Errorf("unknown output format '%s' (use json, jsonl or text)", value)
+}
+
+// newFlagSet returns the flag set for a command, with --output and its short
+// form -o already defined. Parsing the option with each command's flags
+// keeps message text and flag values that look like it untouched.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Func("output", "Output format: json, jsonl or text", setOutputFormat)
+	fs.Func("o", "Shorthand for --output", setOutputFormat)
+	return fs
+}
+
+// extractOutputFlag removes --output/-o given before the command, as in
+// nd --output json receive, and records the chosen format. Anything from
+// the command on is left for the command's own flags.
+func extractOutputFlag(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return args, nil
+	}
+	rest := []string{args[0]}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		var value string
+		switch {
+		case arg == "--output" || arg == "-o":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("%s requires a value (json, jsonl or text)", arg)
+			}
+			value = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--output="):
+			value = strings.TrimPrefix(arg, "--output=")
+		default:
+			return append(rest, args[i:]...), nil
+		}
+		if err := setOutputFormat(value); err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+// isText reports whether human-readable output (including hints) is wanted
+func isText() bool {
+	return outputFormat == outputText
+}
+
+// printJSON writes v as one JSON document, indented unless jsonl was chosen
+func printJSON(v interface{}) {
+	var data []byte
+	if outputFormat == outputJSONL {
+		data, _ = json.Marshal(v)
+	} else {
+		data, _ = json.MarshalIndent(v, "", "  ")
+	}
+	fmt.Println(string(data))
+}
+
+// emit writes a single result, calling text to render it in text mode
+func emit(result interface{}, text func()) {
+	if isText() {
+		text()
+		return
+	}
+	printJSON(result)
+}
+
+// emitList writes a list of records. In json mode the records are wrapped in
+// one object under key together with any extra fields; in jsonl mode each
+// record is written on its own line.
+func emitList[T any](key string, records []T, extra map[string]interface{}, text func()) {
+	switch outputFormat {
+	case outputText:
+		text()
+	case outputJSONL:
+		for _, r := range records {
+			printJSON(r)
+		}
+	default:
+		doc := map[string]interface{}{key: records}
+		for k, v := range extra {
+			doc[k] = v
+		}
+		printJSON(doc)
+	}
+}
+
+// fail reports err in the selected format and exits with its exit code
+func fail(err error) {
+	code := exitCodeFor(err)
+	if isText() {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		report := map[string]interface{}{
+			"error":     err.Error(),
+			"exit_code": code,
+		}
+		var se *serverError
+		if errors.As(err, &se) && se.field != nil {
+			report["field_error"] = se.field
+		}
+		printJSON(report)
+	}
+	os.Exit(code)
+}
+
+// usageError reports an invalid command line, with a usage line in text mode
+func usageError(message, usage string) {
+	if isText() {
+		fmt.Printf("Error: %s\n", message)
+		if usage != "" {
+			fmt.Printf("Usage: %s\n", usage)
+		}
+		os.Exit(exitUsage)
+	}
+	fail(withCode(exitUsage, errors.New(message)))
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	payloadBucket   = "PAYLOADS"
+	requestOverhead = 4096 // Room left in a send request for everything but the payload
+	encodingBase64  = "base64"
+	sniffLen        = 512 // Bytes http.DetectContentType looks at
+)
+
+// payloadMaxKey is the object store metadata in which the server publishes
+// its payload limit
+const payloadMaxKey = "needy.payload-max"
+
+// Payload is what a message carries besides its short text
+type Payload struct {
+	Data        string
+	ContentType string
+	Attachments []string // Paths of files to attach
+}
+
+// Attachment is a named file stored alongside a message
+type Attachment struct {
+	Name        string `json:"name"`
+	Ref         string `json:"ref"`
+	Size        uint64 `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// stringList is a flag that may be given more than once
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// payloadFlags are the flags commands use to attach a payload
+type payloadFlags struct {
+	data        string
+	dataFile    string
+	contentType string
+	attach      stringList
+}
+
+// addPayloadFlags registers --data, --data-file, --content-type and --attach on fs
+func addPayloadFlags(fs *flag.FlagSet) *payloadFlags {
+	p := &payloadFlags{}
+	fs.StringVar(&p.data, "data", "", "Payload data, or - to read it from stdin")
+	fs.StringVar(&p.dataFile, "data-file", "", "Read the payload from this file")
+	fs.StringVar(&p.contentType, "content-type", "", "Media type of the payload (default: sniffed)")
+	fs.Var(&p.attach, "attach", "Attach a file (repeatable)")
+	return p
+}
+
+// payload resolves the parsed flags into a Payload, reading stdin or the
+// data file as needed and sniffing the content type unless it was given
+func (p *payloadFlags) payload() (Payload, error) {
+	if p.data != "" && p.dataFile != "" {
+		return Payload{}, fmt.Errorf("--data and --data-file cannot be combined")
+	}
+
+	data := p.data
+	switch {
+	case p.dataFile != "":
+		content, err := os.ReadFile(p.dataFile)
+		if err != nil {
+			return Payload{}, fmt.Errorf("failed to read --data-file: %w", err)
+		}
+		data = string(content)
+	case p.data == "-":
+		content, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return Payload{}, fmt.Errorf("failed to read payload from stdin: %w", err)
+		}
+		data = string(content)
+	}
+
+	contentType := p.contentType
+	if contentType != "" {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return Payload{}, fmt.Errorf("invalid --content-type %q: %w", contentType, err)
+		}
+		if data != "" && isJSONType(contentType) && !json.Valid([]byte(data)) {
+			return Payload{}, fmt.Errorf("payload is not valid JSON although --content-type is %s", contentType)
+		}
+	} else if data != "" {
+		contentType = sniffContentType(p.dataFile, []byte(data))
+	}
+
+	for _, path := range p.attach {
+		if info, err := os.Stat(path); err != nil {
+			return Payload{}, fmt.Errorf("cannot attach %s: %w", path, err)
+		} else if info.IsDir() {
+			return Payload{}, fmt.Errorf("cannot attach %s: it is a directory", path)
+		}
+	}
+
+	return Payload{Data: data, ContentType: contentType, Attachments: p.attach}, nil
+}
+
+// sniffContentType guesses the media type of a payload, first from the
+// extension of the file it came from, then from the data itself. Data that
+// starts like a JSON document or a patch is recognised as such.
+func sniffContentType(name string, data []byte) string {
+	if ext := filepath.Ext(name); ext != "" {
+		if contentType := mime.TypeByExtension(ext); contentType != "" {
+			return contentType
+		}
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return "application/json"
+	}
+	if looksLikePatch(data) {
+		return patchContentType
+	}
+	return http.DetectContentType(data)
+}
+
+// looksLikePatch reports whether data starts like a unified diff or the
+// output of git format-patch
+func looksLikePatch(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("diff --git ")) ||
+		(bytes.HasPrefix(data, []byte("--- ")) && bytes.Contains(data, []byte("\n+++ "))) ||
+		(bytes.HasPrefix(data, []byte("From ")) && bytes.Contains(data, []byte("\ndiff --git ")))
+}
+
+// isJSONType reports whether contentType is JSON, including +json suffixes
+func isJSONType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// isTextType reports whether a payload of contentType is safe to print.
+// Payloads without a content type predate it and were always text.
+func isTextType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		isJSONType(mediaType),
+		mediaType == "application/xml", strings.HasSuffix(mediaType, "+xml"),
+		mediaType == "application/javascript",
+		mediaType == "application/yaml", mediaType == "application/x-yaml",
+		mediaType == "application/toml":
+		return true
+	}
+	return false
+}
+
+// isBinary reports whether a message's payload must not be printed as text
+func isBinary(m Message) bool {
+	return m.Encoding == encodingBase64 || !isTextType(m.ContentType)
+}
+
+// encodeData returns data as it travels inline in a request: unchanged if
+// it is text, base64 encoded along with its encoding if it is binary
+func encodeData(data string) (string, string) {
+	if utf8.ValidString(data) {
+		return data, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(data)), encodingBase64
+}
+
+// sniffFile guesses the content type of the file at path
+func sniffFile(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = f.Close() }()
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	return sniffContentType(path, head[:n])
+}
+
+// fitsInRequest reports whether data can travel inline in a send request
+func fitsInRequest(nc *nats.Conn, data string) bool {
+	return len(data) <= int(nc.MaxPayload())-requestOverhead
+}
+
+// uploadPayload stores the content of r in the payload object store and
+// returns the reference to send instead of it
+func uploadPayload(nc *nats.Conn, r io.Reader) (string, error) {
+	obs, err := payloadStore(nc)
+	if err != nil {
+		return "", err
+	}
+	name := uuid.New().String()
+	if _, err := obs.Put(&nats.ObjectMeta{Name: name}, r); err != nil {
+		return "", fmt.Errorf("failed to upload payload: %w", err)
+	}
+	return name, nil
+}
+
+// checkPayloadSize refuses data and attachments that together exceed the
+// payload limit the server published with the object store, before any of
+// them is uploaded. Without a published limit the server alone checks.
+func checkPayloadSize(nc *nats.Conn, data string, paths []string) error {
+	obs, err := payloadStore(nc)
+	if err != nil {
+		return err
+	}
+	status, err := obs.Status()
+	if err != nil {
+		return fmt.Errorf("failed to open payload store: %w", err)
+	}
+	limit, err := strconv.ParseUint(status.Metadata()[payloadMaxKey], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	total := uint64(len(data))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("cannot attach %s: %w", path, err)
+		}
+		total += uint64(info.Size())
+	}
+	if total > limit {
+		return fmt.Errorf("payload too large (%d bytes, max %d bytes)", total, limit)
+	}
+	return nil
+}
+
+// discardUploads removes uploaded payloads that no message will reference
+func discardUploads(nc *nats.Conn, refs []string) {
+	obs, err := payloadStore(nc)
+	if err != nil {
+		return
+	}
+	for _, ref := range refs {
+		_ = obs.Delete(ref)
+	}
+}
+
+// uploadAttachments uploads the files at paths, keeping their base names.
+// Attachments are saved under those names, so two files sharing one are
+// refused before anything is uploaded, and if one fails to upload the
+// others are removed again.
+func uploadAttachments(nc *nats.Conn, paths []string) ([]Attachment, error) {
+	names := map[string]string{}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("cannot attach both %s and %s: attachments need distinct file names", other, path)
+		}
+		names[name] = path
+	}
+
+	var attachments []Attachment
+	var refs []string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			discardUploads(nc, refs)
+			return nil, fmt.Errorf("cannot attach %s: %w", path, err)
+		}
+		ref, err := uploadPayload(nc, f)
+		_ = f.Close()
+		if err != nil {
+			discardUploads(nc, refs)
+			return nil, fmt.Errorf("cannot attach %s: %w", path, err)
+		}
+		refs = append(refs, ref)
+		attachments = append(attachments, Attachment{Name: filepath.Base(path), Ref: ref, ContentType: sniffFile(path)})
+	}
+	return attachments, nil
+}
+
+// saveAttachments writes a message's attachments into dir under their
+// original names and returns the paths written. Names already taken by an
+// earlier attachment get a numbered suffix, so none overwrites another.
+func saveAttachments(nc *nats.Conn, attachments []Attachment, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	obs, err := payloadStore(nc)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved []string
+	used := map[string]bool{}
+	for _, a := range attachments {
+		// Names come from other agents, so never let them leave dir
+		name := filepath.Base(a.Name)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			name = a.Ref
+		}
+		name = uniqueName(name, used)
+		path := filepath.Join(dir, name)
+		if err := obs.GetFile(a.Ref, path); err != nil {
+			return saved, fmt.Errorf("failed to save %s: %w", a.Name, err)
+		}
+		saved = append(saved, path)
+	}
+	return saved, nil
+}
+
+// uniqueName returns name, or name with a numbered suffix before its
+// extension if it is already used, and marks the result as used
+func uniqueName(name string, used map[string]bool) string {
+	unique := name
+	ext := filepath.Ext(name)
+	for i := 2; used[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	used[unique] = true
+	return unique
+}
+
+// openPayload returns a reader for a message's decoded payload, streaming
+// it from the object store when the server stored it there
+func openPayload(nc *nats.Conn, m Message) (io.ReadCloser, error) {
+	if m.DataRef == "" {
+		if m.Encoding == encodingBase64 {
+			return io.NopCloser(base64.NewDecoder(base64.StdEncoding, strings.NewReader(m.Data))), nil
+		}
+		return io.NopCloser(strings.NewReader(m.Data)), nil
+	}
+	obs, err := payloadStore(nc)
+	if err != nil {
+		return nil, err
+	}
+	r, err := obs.Get(m.DataRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch payload of message %s: %w", m.ID, err)
+	}
+	return r, nil
+}
+
+// loadPayload fills in Data for a message whose payload is in the object
+// store, base64 encoding it if it is binary
+func loadPayload(nc *nats.Conn, m *Message) error {
+	if m.DataRef == "" {
+		return nil
+	}
+	r, err := openPayload(nc, *m)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to fetch payload of message %s: %w", m.ID, err)
+	}
+	m.Data, m.Encoding = encodeData(string(data))
+	return nil
+}
+
+// printPayload writes a message's decoded payload, or its text if it has
+// none, to stdout. Binary payloads are only written when stdout is not a
+// terminal, and JSON payloads are checked before they are passed on.
+func printPayload(nc *nats.Conn, m Message) error {
+	if m.Data == "" && m.DataRef == "" {
+		fmt.Println(m.Text)
+		return nil
+	}
+	if isBinary(m) && isTerminal(os.Stdout) {
+		contentType := m.ContentType
+		if contentType == "" {
+			contentType = "binary"
+		}
+		fmt.Printf("Message %s carries a %s payload. Redirect it to a file to save it: nd get %s > FILE\n", m.ID, contentType, m.ID)
+		return nil
+	}
+
+	r, err := openPayload(nc, m)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = r.Close() }()
+
+	if isJSONType(m.ContentType) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to fetch payload of message %s: %w", m.ID, err)
+		}
+		if !json.Valid(data) {
+			return fmt.Errorf("payload of message %s is not valid JSON although its content type is %s", m.ID, m.ContentType)
+		}
+		fmt.Println(string(bytes.TrimRight(data, "\n")))
+		return nil
+	}
+	if m.DataRef == "" && !isBinary(m) {
+		fmt.Println(m.Data)
+		return nil
+	}
+
+	// Raw and large payloads are streamed as they are
+	if _, err := io.Copy(os.Stdout, r); err != nil {
+		return fmt.Errorf("failed to fetch payload of message %s: %w", m.ID, err)
+	}
+	return nil
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// payloadStore opens the object store bucket that holds large payloads
+func payloadStore(nc *nats.Conn) (nats.ObjectStore, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payload store: %w", err)
+	}
+	obs, err := js.ObjectStore(payloadBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open payload store: %w", err)
+	}
+	return obs, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Profile tells other agents who an agent is and what it is good at
+type Profile struct {
+	Description string   `json:"description,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Skills      []string `json:"skills,omitempty"`
+	Repo        string   `json:"repo,omitempty"`
+}
+
+// AgentEntry is one agent in the directory
+type AgentEntry struct {
+	Name string `json:"name"`
+	Profile
+	Status   string `json:"status,omitempty"`    // online, idle or offline
+	LastSeen int64  `json:"last_seen,omitempty"` // Unix time the agent last talked to the server
+}
+
+// profileFlags are the flags that describe an agent
+type profileFlags struct {
+	fs       *flag.FlagSet
+	describe string
+	model    string
+	repo     string
+	skills   stringList
+}
+
+// addProfileFlags registers --describe, --model, --skill and --repo on fs
+func addProfileFlags(fs *flag.FlagSet) *profileFlags {
+	p := &profileFlags{fs: fs}
+	fs.StringVar(&p.describe, "describe", "", "What this agent does, in a sentence")
+	fs.StringVar(&p.model, "model", "", "Model or tool the agent runs on")
+	fs.Var(&p.skills, "skill", "Something the agent is good at, e.g. go (repeatable; replaces the current skills)")
+	fs.StringVar(&p.repo, "repo", "", "Repository the agent works in")
+	return p
+}
+
+// update returns the profile fields given on the command line, or nil if
+// none were. Fields left out are not changed on the server.
+func (p *profileFlags) update() map[string]interface{} {
+	update := map[string]interface{}{}
+	p.fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "describe":
+			update["description"] = p.describe
+		case "model":
+			update["model"] = p.model
+		case "skill":
+			update["skills"] = []string(p.skills)
+		case "repo":
+			update["repo"] = p.repo
+		}
+	})
+	if len(update) == 0 {
+		return nil
+	}
+	return update
+}
+
+// handleProfileSet changes the agent's profile
+func handleProfileSet(update map[string]interface{}) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"profile":   update,
+	}
+	var resp struct {
+		Agent AgentEntry `json:"agent"`
+	}
+	if err := request(nc, "needy.profile", req, 5*time.Second, &resp); err != nil {
+		return err
+	}
+
+	emit(resp.Agent, func() {
+		fmt.Println("Profile updated:")
+		printAgent(resp.Agent)
+		fmt.Println("\nSee how others describe themselves with: nd agents")
+	})
+	return nil
+}
+
+// handleAgents lists the registered agents, optionally only those with a skill
+func handleAgents(skill string) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"skill":     skill,
+	}
+	var resp struct {
+		Agents []AgentEntry `json:"agents"`
+	}
+	if err := request(nc, "needy.agents", req, 5*time.Second, &resp); err != nil {
+		return err
+	}
+
+	emitList("agents", resp.Agents, nil, func() {
+		if len(resp.Agents) == 0 {
+			if skill != "" {
+				fmt.Printf("No agents advertise the skill '%s'.\n", skill)
+			} else {
+				fmt.Println("No agents are registered.")
+			}
+			return
+		}
+		for _, a := range resp.Agents {
+			printAgent(a)
+		}
+		fmt.Println("\nDescribe yourself with: nd profile set --describe \"...\" --skill <skill>")
+	})
+	return nil
+}
+
+// printAgent writes one directory entry
+func printAgent(a AgentEntry) {
+	line := a.Name
+	if a.Status == "online" {
+		line += " (online)"
+	} else if a.Status != "" {
+		line += fmt.Sprintf(" (%s, last seen %s ago)", a.Status, roughDuration(time.Since(time.Unix(a.LastSeen, 0))))
+	}
+	if a.Description != "" {
+		line += " - " + a.Description
+	}
+	fmt.Println(line)
+	if len(a.Skills) > 0 {
+		fmt.Printf("  skills: %s\n", strings.Join(a.Skills, ", "))
+	}
+	if a.Model != "" {
+		fmt.Printf("  model:  %s\n", a.Model)
+	}
+	if a.Repo != "" {
+		fmt.Printf("  repo:   %s\n", a.Repo)
+	}
+}
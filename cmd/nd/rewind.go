@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// RewindResult is what nd rewind reports
+type RewindResult struct {
+	Message string `json:"message"`
+	Pending uint64 `json:"pending"`
+}
+
+// handleRewind moves the agent's mailbox back so already-read messages are
+// delivered again, either from a message ID or from a point in time
+func handleRewind(toSeq uint64, since time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+	}
+	if toSeq > 0 {
+		req["to_seq"] = toSeq
+	} else {
+		req["since_ms"] = since.Milliseconds()
+	}
+
+	var result RewindResult
+	if err := request(nc, "needy.rewind", req, 5*time.Second, &result); err != nil {
+		return err
+	}
+
+	emit(result, func() {
+		fmt.Println(result.Message)
+		fmt.Printf("%d message(s) waiting. Read them again with: nd receive\n", result.Pending)
+	})
+	return nil
+}
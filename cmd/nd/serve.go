@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+)
+
+// servePollInterval is how long each server-side wait lasts while serving.
+// It is kept short so an interrupted runner stops taking work promptly.
+const servePollInterval = 5 * time.Second
+
+// withdrawReasonMax is the longest withdrawal reason sent, in bytes. It
+// matches the server's default limit on message text.
+const withdrawReasonMax = 100
+
+// ServeResult is what nd serve reports for each need it handled
+type ServeResult struct {
+	NeedID     string `json:"need_id"`
+	Status     string `json:"status"` // "solved" or "withdrawn"
+	SolutionID string `json:"solution_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// needMatcher decides which needs a runner takes on. A pattern starting with
+// # matches needs tagged with that word in their text; anything else is a
+// regular expression matched against the text.
+type needMatcher func(m Message) bool
+
+// newNeedMatcher compiles a --match pattern; an empty pattern matches every need
+func newNeedMatcher(pattern string) (needMatcher, error) {
+	if pattern == "" {
+		return func(Message) bool { return true }, nil
+	}
+	if strings.HasPrefix(pattern, "#") {
+		tag := strings.ToLower(pattern)
+		return func(m Message) bool {
+			for _, word := range strings.Fields(strings.ToLower(m.Text)) {
+				if strings.TrimRight(word, ".,;:!?") == tag {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --match pattern: %w", err)
+	}
+	return func(m Message) bool { return re.MatchString(m.Text) }, nil
+}
+
+// handleServe runs the agent as a worker: it follows the mailbox, announces
+// intent on every matching need from another agent, pipes the need's payload
+// to the handler command and posts its output as the solution. A handler
+// that exits non-zero withdraws the intent instead. At most concurrency
+// handlers run at once. The mailbox is only peeked at, and just the needs
+// taken on are marked as read, so everything else is left for nd receive.
+// Ctrl-C stops taking new needs and waits for running handlers.
+// A zero duration serves until interrupted.
+func handleServe(match, command string, concurrency int, duration time.Duration) error {
+	matches, err := newNeedMatcher(match)
+	if err != nil {
+		return withCode(exitUsage, err)
+	}
+
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	self := readConfig()["name"]
+
+	nc, err := connect(nats.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Results are written by several handlers, so they go out one at a time
+	if outputFormat == outputJSON {
+		outputFormat = outputJSONL
+	}
+	var outputMu sync.Mutex
+	report := func(result ServeResult) {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+		emit(result, func() {
+			if result.Status == "solved" {
+				fmt.Printf("Solved need %s (solution %s)\n", result.NeedID, result.SolutionID)
+			} else {
+				fmt.Printf("Withdrew from need %s: %s\n", result.NeedID, result.Error)
+			}
+		})
+	}
+
+	if isText() {
+		fmt.Printf("Serving needs with %s (Ctrl-C to stop)...\n", command)
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var running sync.WaitGroup
+	defer running.Wait()
+
+	stopping := func() {
+		if isText() {
+			fmt.Println("Stopping, waiting for running handlers...")
+		}
+	}
+
+	// after is the last message looked at; peeks carry on from there, as
+	// the ones passed over stay unread
+	var after uint64
+	for {
+		select {
+		case <-stop:
+			stopping()
+			return nil
+		default:
+		}
+
+		wait := servePollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+
+		msgs, err := peekMailboxAfter(nc, clientID, wait, after)
+		if err != nil {
+			if exitCodeFor(err) != exitError || nc.IsReconnecting() {
+				// Server busy or restarting; try again shortly
+				time.Sleep(time.Second)
+				continue
+			}
+			return err
+		}
+
+		for _, m := range msgs {
+			if seq, err := strconv.ParseUint(m.ID, 10, 64); err == nil {
+				after = seq
+			}
+			if m.Type != "need" || m.Sender == self || !matches(m) {
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				stopping()
+				return nil
+			}
+			running.Add(1)
+			go func(need Message) {
+				defer running.Done()
+				defer func() { <-slots }()
+				if result, ok := serveNeed(nc, clientID, command, need); ok {
+					report(result)
+				}
+			}(m)
+		}
+	}
+}
+
+// peekMailboxAfter waits up to timeout for unread messages that come after
+// the given message and returns them in the order they were sent, leaving
+// them unread
+func peekMailboxAfter(nc *nats.Conn, clientID string, timeout time.Duration, after uint64) ([]Message, error) {
+	req := map[string]interface{}{
+		"client_id":  clientID,
+		"peek":       true,
+		"timeout_ms": timeout.Milliseconds(),
+	}
+	if after > 0 {
+		req["after"] = after
+	}
+	var resp struct {
+		Messages []Message `json:"messages"`
+	}
+	if err := request(nc, "needy.read", req, timeout+500*time.Millisecond, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Messages, nil
+}
+
+// settleMessage marks a message in the mailbox as read
+func settleMessage(nc *nats.Conn, clientID, id string) error {
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"ids":       []string{id},
+	}
+	return request(nc, "needy.settle", req, 5*time.Second, nil)
+}
+
+// serveNeed claims one need and runs the handler on it. It reports false if
+// the need could not be claimed.
+func serveNeed(nc *nats.Conn, clientID, command string, need Message) (ServeResult, bool) {
+	if _, err := postMessage(nc, clientID, "intent", "", need.ID, "", Payload{}, NeedOptions{}); err != nil {
+		return ServeResult{}, false
+	}
+	// A need that stays unread would be served again after a restart
+	_ = settleMessage(nc, clientID, need.ID)
+
+	var payload io.ReadCloser = io.NopCloser(strings.NewReader(need.Text))
+	if need.Data != "" || need.DataRef != "" {
+		var err error
+		if payload, err = openPayload(nc, need); err != nil {
+			return withdrawNeed(nc, clientID, need, err.Error()), true
+		}
+	}
+	defer func() { _ = payload.Close() }()
+
+	var stdout bytes.Buffer
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = payload
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"NEEDY_NEED_ID="+need.ID,
+		"NEEDY_NEED_TEXT="+need.Text,
+		"NEEDY_NEED_SENDER="+need.Sender,
+	)
+
+	if err := cmd.Run(); err != nil {
+		return withdrawNeed(nc, clientID, need, fmt.Sprintf("handler failed: %v", err)), true
+	}
+
+	result := Payload{Data: stdout.String()}
+	if result.Data != "" {
+		result.ContentType = sniffContentType("", stdout.Bytes())
+	}
+	solution, err := postMessage(nc, clientID, "solution", "", need.ID, "", result, NeedOptions{})
+	if err != nil {
+		return ServeResult{NeedID: need.ID, Status: "withdrawn", Error: fmt.Sprintf("could not post solution: %v", err)}, true
+	}
+	return ServeResult{NeedID: need.ID, Status: "solved", SolutionID: solution.ID}, true
+}
+
+// withdrawNeed gives up a claimed need, giving reason
+func withdrawNeed(nc *nats.Conn, clientID string, need Message, reason string) ServeResult {
+	result := ServeResult{NeedID: need.ID, Status: "withdrawn", Error: reason}
+	if _, err := postMessage(nc, clientID, "withdraw", truncate(reason, withdrawReasonMax), need.ID, "", Payload{}, NeedOptions{}); err != nil {
+		result.Error += fmt.Sprintf(" (withdrawal failed: %v)", err)
+	}
+	return result
+}
+
+// truncate shortens s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SubscribeResult is what nd subscribe reports
+type SubscribeResult struct {
+	Message string   `json:"message"`
+	Filters []string `json:"filters"`
+	Pending uint64   `json:"pending"`
+}
+
+// handleSubscribe changes which messages the server delivers to the agent's
+// mailbox. No types and no mine restores delivery of everything.
+func handleSubscribe(types []string, mine bool) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"types":     types,
+		"mine":      mine,
+	}
+
+	var result SubscribeResult
+	if err := request(nc, "needy.subscribe", req, 5*time.Second, &result); err != nil {
+		return err
+	}
+
+	emit(result, func() {
+		fmt.Println(result.Message)
+		fmt.Printf("%d message(s) waiting. Change it again with: nd subscribe [--types need,solution,...] [--mine]\n", result.Pending)
+	})
+	return nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
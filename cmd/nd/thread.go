@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// NeedSummary is a need in the tree of nd thread. The state of a need
+// with sub-needs rolls theirs up.
+type NeedSummary struct {
+	ID       string        `json:"id"`
+	Sender   string        `json:"sender"`
+	Text     string        `json:"text"`
+	State    string        `json:"state"` // open, in_progress, blocked or solved
+	Solved   int           `json:"sub_needs_solved,omitempty"`
+	SubNeeds []NeedSummary `json:"sub_needs,omitempty"`
+}
+
+// printNeedSummary writes one need of the tree, and its sub-needs below it
+func printNeedSummary(n NeedSummary, indent string) {
+	state := strings.ReplaceAll(n.State, "_", " ")
+	if len(n.SubNeeds) > 0 {
+		state += fmt.Sprintf(", %d of %d sub-needs solved", n.Solved, len(n.SubNeeds))
+	}
+	fmt.Printf("%s[%s] %s (%s) from %s\n", indent, n.ID, n.Text, state, n.Sender)
+	for _, sub := range n.SubNeeds {
+		printNeedSummary(sub, indent+"  ")
+	}
+}
+
+// handleThread shows a need followed by the most recent limit messages that
+// reference it, or as many as the server returns by default if limit is 0,
+// and where it stands among the needs it is part of or depends on
+func handleThread(needID string, limit int) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	nc, err := connect()
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	req := map[string]interface{}{
+		"client_id": clientID,
+		"need_id":   needID,
+	}
+	if limit > 0 {
+		req["max"] = limit
+	}
+
+	var resp struct {
+		NeedID    string        `json:"need_id"`
+		Messages  []Message     `json:"messages"`
+		More      int           `json:"more"`
+		Tree      NeedSummary   `json:"tree"`
+		Parent    *NeedSummary  `json:"parent"`
+		DependsOn []NeedSummary `json:"depends_on"`
+	}
+	if err := request(nc, "needy.thread", req, 5*time.Second, &resp); err != nil {
+		return err
+	}
+
+	extra := map[string]interface{}{
+		"need_id":    resp.NeedID,
+		"tree":       resp.Tree,
+		"depends_on": resp.DependsOn,
+		"more":       resp.More,
+	}
+	if resp.Parent != nil {
+		extra["parent"] = resp.Parent
+	}
+	emitList("messages", resp.Messages, extra, func() {
+		for i, m := range resp.Messages {
+			indent := ""
+			if i > 0 {
+				indent = "  "
+			}
+			when := time.Unix(m.Timestamp, 0).Format("2006-01-02 15:04:05")
+			line := fmt.Sprintf("%s[%s] %s from %s at %s", indent, m.ID, strings.ToUpper(m.Type), m.Sender, when)
+			if m.Truncated {
+				line += fmt.Sprintf(": (too large to show here; read it with: nd get %s)", m.ID)
+			} else if m.Text != "" {
+				line += ": " + m.Text
+			}
+			fmt.Println(line)
+			if i == 0 && resp.More > 0 {
+				fmt.Printf("  (%d earlier message(s) not shown. Show more with: nd thread %s --max %d)\n", resp.More, resp.NeedID, len(resp.Messages)-1+resp.More)
+			}
+		}
+		if len(resp.Messages) == 1 {
+			fmt.Println("\nNo replies yet.")
+		}
+
+		if resp.Parent != nil {
+			fmt.Println("\nPart of:")
+			printNeedSummary(*resp.Parent, "  ")
+		}
+		if len(resp.DependsOn) > 0 {
+			fmt.Println("\nDepends on:")
+			for _, dep := range resp.DependsOn {
+				printNeedSummary(dep, "  ")
+			}
+		}
+		if len(resp.Tree.SubNeeds) > 0 {
+			fmt.Println("\nSub-needs:")
+			printNeedSummary(resp.Tree, "  ")
+		} else {
+			fmt.Printf("\nNeed %s is %s.\n", resp.NeedID, strings.ReplaceAll(resp.Tree.State, "_", " "))
+		}
+		fmt.Println("\nUse \"nd get <id>\" to retrieve the full payload of a message.")
+	})
+	return nil
+}
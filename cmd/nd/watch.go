@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// watchIdle is how long a watcher waits without hearing from the server,
+// not even a keepalive, before it asks for the watch again. The server
+// sends keepalives every 15 seconds.
+const watchIdle = 40 * time.Second
+
+// handleWatch subscribes to an inbox and has the server push mailbox
+// messages to it as they arrive. Every message is confirmed after it has
+// been printed, and the server only marks confirmed messages as read, so
+// nothing is lost when the watcher stops or the connection drops.
+// A zero duration watches until interrupted.
+//
+// On the way out the watch is stopped, which the server answers once it has
+// let go of the mailbox, so a read right after sees what was not printed.
+func handleWatch(duration time.Duration) error {
+	clientID, _, err := getOrCreateClientID()
+	if err != nil {
+		return fmt.Errorf("failed to get client ID: %w", err)
+	}
+
+	reconnected := make(chan struct{}, 1)
+	nc, err := connect(
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, _ error) {
+			fmt.Fprintln(os.Stderr, "Connection lost, reconnecting...")
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			fmt.Fprintln(os.Stderr, "Reconnected, resuming from your mailbox position.")
+			select {
+			case reconnected <- struct{}{}:
+			default:
+			}
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	// A stream has no single document to wrap, so json is written as jsonl
+	if outputFormat == outputJSON {
+		outputFormat = outputJSONL
+	}
+
+	// Deliveries arrive one at a time on the subscription, so printing
+	// needs no locking
+	heard := make(chan struct{}, 1)
+	hinted := false
+	inbox := nats.NewInbox()
+	sub, err := nc.Subscribe(inbox, func(m *nats.Msg) {
+		var delivery struct {
+			Message
+			Keepalive bool `json:"keepalive"`
+		}
+		if err := json.Unmarshal(m.Data, &delivery); err == nil && !delivery.Keepalive {
+			msgs := []Message{delivery.Message}
+			emitList("messages", msgs, nil, func() {
+				if printMessages(msgs)["need"] && !hinted {
+					fmt.Println("  -> To respond to a need, first announce your intent: nd send intent <need-id>")
+					hinted = true
+				}
+			})
+		}
+		_ = m.Respond([]byte(`{"success": true}`))
+		select {
+		case heard <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		return withCode(exitUnavailable, fmt.Errorf("could not subscribe: %w", err))
+	}
+	startWatch := func() error {
+		req := map[string]interface{}{
+			"client_id": clientID,
+			"inbox":     inbox,
+		}
+		return request(nc, "needy.watch", req, 5*time.Second, nil)
+	}
+	if err := startWatch(); err != nil {
+		_ = sub.Unsubscribe()
+		return err
+	}
+	defer func() {
+		// Deliveries still under way fail once the inbox is gone and go
+		// back to the mailbox
+		_ = sub.Unsubscribe()
+		req := map[string]interface{}{
+			"client_id": clientID,
+			"inbox":     inbox,
+			"stop":      true,
+		}
+		_ = request(nc, "needy.watch", req, 5*time.Second, nil)
+	}()
+	if isText() {
+		fmt.Println("Watching for new messages (Ctrl-C to stop)...")
+	}
+
+	var expired <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	idle := time.NewTimer(watchIdle)
+	defer idle.Stop()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	for {
+		select {
+		case <-expired:
+			return nil
+		case <-stop:
+			return nil
+		case <-heard:
+		case <-reconnected:
+			// The server may have restarted and forgotten the watch
+			if err := startWatch(); err != nil && exitCodeFor(err) == exitError {
+				return err
+			}
+		case <-idle.C:
+			// Silence means the watch ended on the server; ask again
+			if err := startWatch(); err != nil && exitCodeFor(err) == exitError {
+				return err
+			}
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(watchIdle)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// handleAwait waits up to the requested time for the first solution to a
+// need and returns it. It reads through its own short-lived consumer, so
+// waiting never touches the agent's mailbox. A reply without a solution
+// means the wait ran out and the client may ask again.
+func handleAwait(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	js, _ := nc.JetStream()
+
+	needID, _ := req["need_id"].(string)
+	owner := needOwner(js, needID)
+	if owner == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Need not found"}`))
+		return
+	}
+	var seq uint64
+	_, _ = fmt.Sscanf(needID, "%d", &seq)
+
+	waitDuration := 100 * time.Millisecond
+	if timeoutMs, ok := req["timeout_ms"].(float64); ok && timeoutMs > 0 {
+		waitDuration = time.Duration(timeoutMs) * time.Millisecond
+	}
+	deadline := time.Now().Add(waitDuration)
+
+	// Solutions are published with their need's owner in the subject and
+	// are always stored after the need
+	filter := fmt.Sprintf("%s.solution.*.%s", messageSubj, agentToken(owner))
+	sub, closeReader, err := openReader(js, seq+1, filter, nil)
+	if err != nil {
+		log.Printf("Await failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error waiting for solution"}`))
+		return
+	}
+	defer closeReader()
+
+	var solution map[string]interface{}
+	for solution == nil {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		msgs, err := fetchMailbox(sub, scanBatch, remaining)
+		if err != nil {
+			log.Printf("Await failed: %v", err)
+			_ = msg.Respond([]byte(`{"success": false, "message": "Internal error waiting for solution"}`))
+			return
+		}
+		for _, m := range msgs {
+			if entry := mailboxEntry(m); entry["need_id"] == needID {
+				solution = entry
+				break
+			}
+		}
+	}
+
+	resp := map[string]interface{}{
+		"success":  true,
+		"need_id":  needID,
+		"solution": solution,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
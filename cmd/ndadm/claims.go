@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	pathsMax = 32  // Most path globs one intent may claim
+	pathMax  = 256 // Longest path glob
+)
+
+// PathConflict is an open intent of another agent whose paths overlap the
+// ones just claimed
+type PathConflict struct {
+	Agent  string   `json:"agent"`
+	NeedID string   `json:"need_id"`
+	Paths  []string `json:"paths"` // The other intent's globs that overlap
+}
+
+// pathsField returns the normalised path globs listed in a request field.
+// Globs use the syntax of path.Match, plus ** for any number of directories.
+func pathsField(req map[string]interface{}, field string) ([]string, *fieldError) {
+	raw, ok := req[field]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, &fieldError{Code: errInvalidType, Field: field, message: fmt.Sprintf("Field %s must be a list of strings", field)}
+	}
+	if len(list) > pathsMax {
+		return nil, &fieldError{Code: errTooMany, Field: field, Limit: pathsMax, message: fmt.Sprintf("Too many paths (max %d). Claim a directory instead, e.g. cmd/nd/**", pathsMax)}
+	}
+	var paths []string
+	seen := map[string]bool{}
+	for _, item := range list {
+		p, ok := item.(string)
+		if !ok {
+			return nil, &fieldError{Code: errInvalidType, Field: field, message: fmt.Sprintf("Field %s must be a list of strings", field)}
+		}
+		if len(p) > pathMax {
+			return nil, &fieldError{Code: errTooLong, Field: field, Limit: pathMax, message: fmt.Sprintf("Path too long (max %d chars)", pathMax)}
+		}
+		p = path.Clean(strings.TrimPrefix(strings.TrimSpace(p), "./"))
+		if p == "." || strings.HasPrefix(p, "/") || strings.HasPrefix(p, "../") {
+			return nil, &fieldError{Code: errInvalidValue, Field: field, message: fmt.Sprintf("Invalid path '%s'. Use a path relative to the repository root, e.g. cmd/nd/**", p)}
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, &fieldError{Code: errInvalidValue, Field: field, message: fmt.Sprintf("Invalid path glob '%s'", p)}
+		}
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// globsOverlap reports whether some path could match both globs. Where
+// both sides of a path segment are wildcards, they are taken to overlap
+// unless their fixed prefixes differ.
+func globsOverlap(a, b string) bool {
+	return segmentsOverlap(strings.Split(a, "/"), strings.Split(b, "/"))
+}
+
+func segmentsOverlap(a, b []string) bool {
+	switch {
+	case len(a) > 0 && a[0] == "**":
+		return segmentsOverlap(a[1:], b) || len(b) > 0 && segmentsOverlap(a, b[1:])
+	case len(b) > 0 && b[0] == "**":
+		return segmentsOverlap(a, b[1:]) || len(a) > 0 && segmentsOverlap(a[1:], b)
+	case len(a) == 0 || len(b) == 0:
+		return len(a) == len(b)
+	}
+	return segmentOverlaps(a[0], b[0]) && segmentsOverlap(a[1:], b[1:])
+}
+
+// segmentOverlaps reports whether some file name could match both patterns
+func segmentOverlaps(a, b string) bool {
+	const wildcards = "*?["
+	switch {
+	case !strings.ContainsAny(a, wildcards):
+		ok, _ := path.Match(b, a)
+		return ok
+	case !strings.ContainsAny(b, wildcards):
+		ok, _ := path.Match(a, b)
+		return ok
+	}
+	pa, pb := a[:strings.IndexAny(a, wildcards)], b[:strings.IndexAny(b, wildcards)]
+	return strings.HasPrefix(pa, pb) || strings.HasPrefix(pb, pa)
+}
+
+// overlapping returns the globs of theirs that overlap any of ours
+func overlapping(ours, theirs []string) []string {
+	var hits []string
+	for _, t := range theirs {
+		for _, o := range ours {
+			if globsOverlap(o, t) {
+				hits = append(hits, t)
+				break
+			}
+		}
+	}
+	return hits
+}
+
+// publishConflict tells the other party of a conflict that an agent has
+// just claimed paths overlapping theirs
+func publishConflict(js nats.JetStreamContext, agentName, needID string, paths []string, c PathConflict) {
+	msg := Message{
+		Type:      "conflict",
+		Sender:    serverSender,
+		Text:      fmt.Sprintf("%s is working on %s for need %s, which overlaps your %s for need %s", agentName, strings.Join(paths, ", "), needID, strings.Join(c.Paths, ", "), c.NeedID),
+		NeedID:    c.NeedID,
+		Recipient: c.Agent,
+		Paths:     paths,
+		Timestamp: makeTimestamp(),
+	}
+	msgData, _ := json.Marshal(msg)
+	if _, err := js.Publish(messageSubject("conflict", serverSender, c.Agent), msgData); err != nil {
+		log.Printf("Failed to publish conflict: %v", err)
+		return
+	}
+	fmt.Printf("ndadm: Warned '%s' that '%s' claims overlapping paths\n", c.Agent, agentName)
+}
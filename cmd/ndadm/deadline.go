@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultDeadlineReminder is how many seconds before a need's deadline
+// the agents working on it are reminded
+const defaultDeadlineReminder = 300
+
+// deadlineReminder is the reminder lead time in seconds (config:
+// deadline-reminder). Needs with less time than four times this get
+// reminded when a quarter of their time is left.
+var deadlineReminder = defaultDeadlineReminder
+
+// deadlineTick is how often the deadlines of open needs are checked
+const deadlineTick = 250 * time.Millisecond
+
+// validateDeadline checks the deadline field of a send request: a Unix
+// time in the future, and only on needs
+func validateDeadline(req map[string]interface{}, msgType string) *fieldError {
+	raw, ok := req["deadline"]
+	if !ok || raw == nil {
+		return nil
+	}
+	deadline, ok := raw.(float64)
+	if !ok {
+		return &fieldError{Code: errInvalidType, Field: "deadline", message: "Field deadline must be a Unix time in seconds"}
+	}
+	if msgType != "need" {
+		return &fieldError{Code: errInvalidValue, Field: "deadline", message: "Only needs have a deadline"}
+	}
+	if int64(deadline) <= time.Now().Unix() {
+		return &fieldError{Code: errInvalidValue, Field: "deadline", message: "The deadline has already passed"}
+	}
+	return nil
+}
+
+// reminderLead returns how long before a deadline set at sent the agents
+// working on the need are reminded
+func reminderLead(sent, due time.Time) time.Duration {
+	return min(time.Duration(deadlineReminder)*time.Second, due.Sub(sent)/4)
+}
+
+// restoreDeadlines watches the deadlines of the needs in the stream that
+// have neither a solution nor an overdue notice yet, so a restart does not
+// forget them. The intents on those needs, which decide who is reminded,
+// are restored with them, and agents already reminded are not reminded again.
+func restoreDeadlines(js nats.JetStreamContext) error {
+	open := map[string]map[string]interface{}{}
+	intents := map[string]map[string]bool{}  // NeedID -> agents with intent
+	reminded := map[string]map[string]bool{} // NeedID -> agents reminded
+	err := scanStream(js, 1, func(m *nats.Msg) bool {
+		entry := mailboxEntry(m)
+		id, _ := entry["id"].(string)
+		needID, _ := entry["need_id"].(string)
+		sender, _ := entry["sender"].(string)
+		switch entry["type"] {
+		case "need":
+			if deadline, _ := entry["deadline"].(int64); deadline > 0 {
+				open[id] = entry
+				intents[id] = map[string]bool{}
+				reminded[id] = map[string]bool{}
+			}
+		case "intent":
+			if agents, ok := intents[needID]; ok {
+				agents[sender] = true
+			}
+		case "withdraw":
+			delete(intents[needID], sender)
+		case "reminder":
+			if agents, ok := reminded[needID]; ok {
+				recipient, _ := entry["recipient"].(string)
+				agents[recipient] = true
+			}
+		case "solution", "overdue":
+			delete(open, needID)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for id, need := range open {
+		owner, _ := need["sender"].(string)
+		text, _ := need["text"].(string)
+		sent := time.Unix(need["timestamp"].(int64), 0)
+		due := time.Unix(need["deadline"].(int64), 0)
+		registry.TrackDeadline(id, owner, text, due, reminderLead(sent, due))
+		for agent := range intents[id] {
+			registry.RecordIntent(agent, id)
+		}
+		for agent := range reminded[id] {
+			registry.MarkReminded(id, agent)
+		}
+	}
+	if len(open) > 0 {
+		fmt.Printf("ndadm: Watching the deadlines of %d open need(s)\n", len(open))
+	}
+	return nil
+}
+
+// watchDeadlines publishes the reminders and overdue notices of open needs
+// as they fall due, until the connection is closed
+func watchDeadlines(nc *nats.Conn) {
+	js, _ := nc.JetStream()
+	ticker := time.NewTicker(deadlineTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if nc.IsClosed() {
+			return
+		}
+		for _, ev := range registry.DueDeadlines(time.Now()) {
+			publishDeadlineEvent(js, ev)
+		}
+	}
+}
+
+// publishDeadlineEvent stores a reminder or overdue notice addressed to a
+// single agent
+func publishDeadlineEvent(js nats.JetStreamContext, ev DeadlineEvent) {
+	text := fmt.Sprintf("Need %s is due in %s: %s", ev.NeedID, time.Until(ev.Due).Round(time.Second), ev.Text)
+	if ev.Type == "overdue" {
+		text = fmt.Sprintf("Need %s is overdue without a solution: %s", ev.NeedID, ev.Text)
+	}
+
+	msg := Message{
+		Type:      ev.Type,
+		Sender:    serverSender,
+		Text:      text,
+		NeedID:    ev.NeedID,
+		Recipient: ev.Agent,
+		Deadline:  ev.Due.Unix(),
+		Timestamp: makeTimestamp(),
+	}
+	msgData, _ := json.Marshal(msg)
+	if _, err := js.Publish(messageSubject(ev.Type, serverSender, ev.Agent), msgData); err != nil {
+		log.Printf("Failed to publish %s: %v", ev.Type, err)
+		return
+	}
+	fmt.Printf("ndadm: Sent %s on need %s to '%s'\n", ev.Type, ev.NeedID, ev.Agent)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// dependsMax is the most needs one need may depend on
+const dependsMax = 20
+
+// States of a need in the graph of needs
+const (
+	needOpen       = "open"        // Nobody has announced intent yet
+	needInProgress = "in_progress" // An agent has intent on it, or on one of its sub-needs
+	needBlocked    = "blocked"     // A need it depends on has no solution yet
+	needSolved     = "solved"
+)
+
+// needNode is a need in the graph built from the stream. Edges only ever
+// point at needs stored earlier, so the graph cannot have cycles.
+type needNode struct {
+	id        string
+	sender    string
+	text      string
+	parent    string
+	dependsOn []string
+	children  []string
+	intent    bool // Some agent has announced intent
+	solved    bool
+}
+
+// NeedSummary is a need as it appears in the tree of nd thread, with the
+// state of its sub-needs rolled up into its own
+type NeedSummary struct {
+	ID       string        `json:"id"`
+	Sender   string        `json:"sender"`
+	Text     string        `json:"text"`
+	State    string        `json:"state"`
+	Solved   int           `json:"sub_needs_solved,omitempty"` // How many of its sub-needs are solved
+	SubNeeds []NeedSummary `json:"sub_needs,omitempty"`
+}
+
+// needGraphs is the graph of needs read from the stream so far. Each use
+// reads only the messages stored since the one before.
+var needGraphs = struct {
+	sync.Mutex
+	graph map[string]*needNode
+	next  uint64 // First stream sequence not read yet
+}{graph: map[string]*needNode{}, next: 1}
+
+// withNeedGraph brings the graph of needs up to date with the stream and
+// calls fn with it: every need, linked to its parent, its sub-needs and the
+// needs it depends on. The graph is shared, so fn must not keep or change it.
+func withNeedGraph(js nats.JetStreamContext, fn func(graph map[string]*needNode)) error {
+	needGraphs.Lock()
+	defer needGraphs.Unlock()
+
+	info, err := js.StreamInfo(messageStream)
+	if err != nil {
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+	if info.State.LastSeq >= needGraphs.next {
+		err := scanStream(js, needGraphs.next, func(m *nats.Msg) bool {
+			if meta, err := m.Metadata(); err == nil {
+				needGraphs.next = meta.Sequence.Stream + 1
+			}
+			addToGraph(needGraphs.graph, mailboxEntry(m))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fn(needGraphs.graph)
+	return nil
+}
+
+// addToGraph adds a stored message to the graph of needs
+func addToGraph(graph map[string]*needNode, entry map[string]interface{}) {
+	id, _ := entry["id"].(string)
+	needID, _ := entry["need_id"].(string)
+	switch entry["type"] {
+	case "need":
+		node := &needNode{id: id}
+		node.sender, _ = entry["sender"].(string)
+		node.text, _ = entry["text"].(string)
+		node.parent, _ = entry["parent"].(string)
+		node.dependsOn, _ = entry["depends_on"].([]string)
+		graph[id] = node
+		if parent, ok := graph[node.parent]; ok {
+			parent.children = append(parent.children, id)
+		}
+	case "intent":
+		if node, ok := graph[needID]; ok {
+			node.intent = true
+		}
+	case "solution":
+		if node, ok := graph[needID]; ok {
+			node.solved = true
+		}
+	}
+}
+
+// unsolved returns the needs id depends on that have no solution yet
+func unsolved(graph map[string]*needNode, id string) []string {
+	var blockers []string
+	node, ok := graph[id]
+	if !ok {
+		return nil
+	}
+	for _, dep := range node.dependsOn {
+		if d, ok := graph[dep]; ok && !d.solved {
+			blockers = append(blockers, dep)
+		}
+	}
+	return blockers
+}
+
+// summarize returns a need with its sub-needs, rolling their state up: a
+// need whose sub-needs are being worked on is in progress itself
+func summarize(graph map[string]*needNode, id string) NeedSummary {
+	node := graph[id]
+	s := NeedSummary{ID: id, Sender: node.sender, Text: node.text}
+	started := node.intent
+	for _, child := range node.children {
+		sub := summarize(graph, child)
+		if sub.State == needSolved {
+			s.Solved++
+		}
+		if sub.State == needSolved || sub.State == needInProgress {
+			started = true
+		}
+		s.SubNeeds = append(s.SubNeeds, sub)
+	}
+
+	switch {
+	case node.solved:
+		s.State = needSolved
+	case len(unsolved(graph, id)) > 0:
+		s.State = needBlocked
+	case started:
+		s.State = needInProgress
+	default:
+		s.State = needOpen
+	}
+	return s
+}
+
+// summary returns a need without its sub-needs
+func summary(graph map[string]*needNode, id string) NeedSummary {
+	s := summarize(graph, id)
+	s.SubNeeds, s.Solved = nil, 0
+	return s
+}
+
+// blockedMessage explains why a need cannot be solved yet
+func blockedMessage(needID string, blockers []string) string {
+	return fmt.Sprintf("Need %s depends on need(s) %s, which have no solution yet. Follow them with: nd thread %s", needID, strings.Join(blockers, ", "), blockers[0])
+}
+
+// needRef parses the ID of a need, which is its stream sequence
+func needRef(raw interface{}) (uint64, bool) {
+	s, _ := raw.(string)
+	seq, err := strconv.ParseUint(s, 10, 64)
+	return seq, err == nil && seq > 0
+}
+
+// needLinks returns the parent and the dependencies a send request names
+func needLinks(req map[string]interface{}) (string, []string) {
+	var parent string
+	if seq, ok := needRef(req["parent"]); ok {
+		parent = fmt.Sprintf("%d", seq)
+	}
+	var deps []string
+	list, _ := req["depends_on"].([]interface{})
+	for _, item := range list {
+		if seq, ok := needRef(item); ok && !slices.Contains(deps, fmt.Sprintf("%d", seq)) {
+			deps = append(deps, fmt.Sprintf("%d", seq))
+		}
+	}
+	return parent, deps
+}
+
+// validateNeedLinks checks the parent and depends_on fields of a send
+// request: need IDs, and only on needs
+func validateNeedLinks(req map[string]interface{}, msgType string) *fieldError {
+	if raw, ok := req["parent"]; ok && raw != nil {
+		if msgType != "need" {
+			return &fieldError{Code: errInvalidValue, Field: "parent", message: "Only needs can have a parent"}
+		}
+		if _, ok := needRef(raw); !ok {
+			return &fieldError{Code: errInvalidValue, Field: "parent", message: "Field parent must be the ID of a need"}
+		}
+	}
+
+	raw, ok := req["depends_on"]
+	if !ok || raw == nil {
+		return nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return &fieldError{Code: errInvalidType, Field: "depends_on", message: "Field depends_on must be a list of need IDs"}
+	}
+	if len(list) > 0 && msgType != "need" {
+		return &fieldError{Code: errInvalidValue, Field: "depends_on", message: "Only needs can depend on other needs"}
+	}
+	if len(list) > dependsMax {
+		return &fieldError{Code: errTooMany, Field: "depends_on", Limit: dependsMax, message: fmt.Sprintf("Too many dependencies (max %d). Group them under a parent need instead", dependsMax)}
+	}
+	for _, item := range list {
+		if _, ok := needRef(item); !ok {
+			return &fieldError{Code: errInvalidValue, Field: "depends_on", message: "Field depends_on must be a list of need IDs"}
+		}
+	}
+	return nil
+}
+
+// blockingNeeds returns the dependencies of a need that have no solution
+// yet. Only needs with dependencies need the graph of needs.
+func blockingNeeds(js nats.JetStreamContext, needID string) ([]string, error) {
+	seq, ok := needRef(needID)
+	if !ok {
+		return nil, nil
+	}
+	m, err := js.GetMsg(messageStream, seq)
+	if err != nil {
+		return nil, nil
+	}
+	var need Message
+	if err := json.Unmarshal(m.Data, &need); err != nil || len(need.DependsOn) == 0 {
+		return nil, nil
+	}
+
+	var blockers []string
+	err = withNeedGraph(js, func(graph map[string]*needNode) {
+		blockers = unsolved(graph, fmt.Sprintf("%d", seq))
+	})
+	return blockers, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultHistory is how many sent messages a history request returns when
+// it does not ask for a number
+const defaultHistory = 20
+
+// handleHistory lists the most recent messages an agent has sent, direct
+// messages included, oldest first. Direct messages never come back to the
+// sender's mailbox, so this is where the sender finds their copy.
+func handleHistory(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	limit := defaultHistory
+	if n, ok := req["max"].(float64); ok {
+		if n < 1 {
+			_ = msg.Respond([]byte(`{"success": false, "message": "max must be a positive number"}`))
+			return
+		}
+		limit = int(n)
+	}
+
+	// The sender is the fourth subject token, with or without a target after it
+	token := agentToken(agentName)
+	filters := []string{
+		fmt.Sprintf("%s.*.%s", messageSubj, token),
+		fmt.Sprintf("%s.*.%s.*", messageSubj, token),
+	}
+
+	js, _ := nc.JetStream()
+	var sent []map[string]interface{}
+	err := scanSubjects(js, 1, filters, func(m *nats.Msg) bool {
+		sent = append(sent, mailboxEntry(m))
+		if len(sent) > limit {
+			sent = sent[1:]
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("History scan failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error listing history"}`))
+		return
+	}
+
+	// The newest messages matter most, so older ones are cut down to stubs
+	// first, and dropped once not even a stub fits in the reply
+	budget := int(nc.MaxPayload()) - replyOverhead
+	first := len(sent)
+	for first > 0 {
+		entry := sent[first-1]
+		entryData, _ := json.Marshal(entry)
+		if len(entryData)+1 > budget {
+			entry = stubEntry(entry)
+			entryData, _ = json.Marshal(entry)
+		}
+		if len(entryData)+1 > budget {
+			break
+		}
+		budget -= len(entryData) + 1
+		sent[first-1] = entry
+		first--
+	}
+
+	resp := map[string]interface{}{
+		"success":  true,
+		"messages": append([]map[string]interface{}{}, sent[first:]...),
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// startHTTPServer serves the HTTP push endpoints on the given port
+func startHTTPServer(nc *nats.Conn, port int) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, r *http.Request) {
+		handleWatchSSE(nc, w, r)
+	})
+
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("HTTP server stopped: %v", err)
+		}
+	}()
+	fmt.Printf("ndadm: Streaming mailboxes over HTTP at http://%s/watch\n", addr)
+}
+
+// handleWatchSSE streams an agent's mailbox as Server-Sent Events. Each
+// message is acknowledged only after it has been flushed to the client, so
+// a dropped connection resumes from the durable consumer position.
+func handleWatchSSE(nc *nats.Conn, w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		clientID = r.Header.Get("X-Needy-Client-Id")
+	}
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		http.Error(w, "Not registered. Please register first: nd register --name <your-name>", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := nc.JetStream()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	fmt.Printf("ndadm: Agent '%s' is watching over HTTP\n", agentName)
+
+	deliver := func(entry map[string]interface{}) error {
+		data, _ := json.Marshal(entry)
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", entry["id"], data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	keepalive := func() error {
+		if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	if err := followMailbox(js, agentName, clientID, r.Context().Done(), deliver, keepalive); err != nil && r.Context().Err() == nil {
+		log.Printf("Watch failed: %v", err)
+	}
+}
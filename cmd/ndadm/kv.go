@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	scratchpadBucket  = "SCRATCHPAD"
+	scratchpadHistory = 10        // Revisions kept per key
+	keyMax            = 128       // Longest scratchpad key
+	defaultKVValueMax = 64 * 1024 // Largest scratchpad value in bytes
+)
+
+// kvValueMax is the largest scratchpad value in bytes (config: kv-value-max)
+var kvValueMax = defaultKVValueMax
+
+// scratchpadKey matches the keys JetStream accepts: dot-separated tokens of
+// letters, digits and - / _ =
+var scratchpadKey = regexp.MustCompile(`^[-/_=a-zA-Z0-9]+(\.[-/_=a-zA-Z0-9]+)*$`)
+
+// KVValue is what the scratchpad stores under a key. The agent that first
+// set a key owns it until it is deleted.
+type KVValue struct {
+	Value     string `json:"value"`
+	Owner     string `json:"owner"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// setupScratchpad creates the key-value bucket agents share state in
+func setupScratchpad(js nats.JetStreamContext) error {
+	_, err := js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:      scratchpadBucket,
+		Description: "Shared scratchpad for agents",
+		History:     scratchpadHistory,
+		Storage:     nats.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create scratchpad: %w", err)
+	}
+	return nil
+}
+
+// validateKVRequest checks the fields of a scratchpad write
+func validateKVRequest(req map[string]interface{}) *fieldError {
+	op, fe := stringField(req, "op")
+	if fe != nil {
+		return fe
+	}
+	if op != "set" && op != "delete" {
+		return &fieldError{Code: errInvalidValue, Field: "op", message: fmt.Sprintf("Unknown scratchpad operation '%s' (use set or delete)", op)}
+	}
+
+	key, fe := boundedField(req, "key", keyMax)
+	if fe != nil {
+		return fe
+	}
+	if key == "" {
+		return &fieldError{Code: errRequired, Field: "key", message: "A key is required"}
+	}
+	if !scratchpadKey.MatchString(key) {
+		return &fieldError{Code: errInvalidValue, Field: "key", message: fmt.Sprintf("Invalid key '%s'. Use letters, digits and - / _ =, with dots between parts, e.g. ci.test-command", key)}
+	}
+
+	if _, fe := boundedField(req, "value", kvValueMax); fe != nil {
+		return fe
+	}
+
+	if raw, ok := req["if_revision"]; ok && raw != nil {
+		if rev, ok := raw.(float64); !ok || rev < 0 {
+			return &fieldError{Code: errInvalidType, Field: "if_revision", message: "Field if_revision must be a revision number"}
+		}
+	}
+	return nil
+}
+
+// handleKV sets or deletes a scratchpad key on behalf of an agent. Only the
+// owner of a key may change it, and a write with if_revision only goes
+// ahead if the key is still at that revision (0: does not exist yet).
+// Reads go to the bucket directly.
+func handleKV(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	if fe := validateKVRequest(req); fe != nil {
+		respondFieldError(msg, fe)
+		return
+	}
+	op, _ := req["op"].(string)
+	key, _ := req["key"].(string)
+	value, _ := req["value"].(string)
+	ifRevision, checkRevision := req["if_revision"].(float64)
+
+	js, _ := nc.JetStream()
+	kv, err := js.KeyValue(scratchpadBucket)
+	if err != nil {
+		log.Printf("Scratchpad unavailable: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error opening scratchpad"}`))
+		return
+	}
+
+	// The current entry decides who owns the key and which revision the
+	// write replaces
+	var current uint64
+	entry, err := kv.Get(key)
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+		// Unset or deleted keys belong to nobody
+	case err != nil:
+		log.Printf("Scratchpad read failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error reading scratchpad"}`))
+		return
+	default:
+		var stored KVValue
+		_ = json.Unmarshal(entry.Value(), &stored)
+		if stored.Owner != agentName {
+			_ = msg.Respond(failureReply(fmt.Sprintf("Key '%s' belongs to %s. Ask them to change it: nd send dm %s \"<message>\"", key, stored.Owner, stored.Owner)))
+			return
+		}
+		current = entry.Revision()
+	}
+	if checkRevision && uint64(ifRevision) != current {
+		respondFieldError(msg, &fieldError{Code: errConflict, Field: "if_revision", message: revisionConflict(key, current)})
+		return
+	}
+	if op == "delete" && current == 0 {
+		_ = msg.Respond(failureReply(fmt.Sprintf("Key '%s' not found", key)))
+		return
+	}
+
+	// Writes are conditional on the revision read above, so a concurrent
+	// write in between is reported as a conflict instead of overwritten
+	var revision uint64
+	if op == "delete" {
+		err = kv.Delete(key, nats.LastRevision(current))
+	} else {
+		data, _ := json.Marshal(KVValue{Value: value, Owner: agentName, Timestamp: makeTimestamp()})
+		if current == 0 {
+			revision, err = kv.Create(key, data)
+		} else {
+			revision, err = kv.Update(key, data, current)
+		}
+	}
+	if err != nil {
+		if latest, getErr := kv.Get(key); getErr == nil && latest.Revision() != current {
+			respondFieldError(msg, &fieldError{Code: errConflict, Field: "if_revision", message: revisionConflict(key, latest.Revision())})
+			return
+		}
+		log.Printf("Scratchpad write failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error writing scratchpad"}`))
+		return
+	}
+
+	text := fmt.Sprintf("Set %s (revision %d)", key, revision)
+	if op == "delete" {
+		text = fmt.Sprintf("Deleted %s", key)
+	}
+
+	resp := map[string]interface{}{
+		"success":  true,
+		"message":  text,
+		"key":      key,
+		"revision": revision,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+	fmt.Printf("ndadm: Agent '%s' changed scratchpad key '%s'\n", agentName, key)
+}
+
+// revisionConflict explains that a key is not at the revision a write expected
+func revisionConflict(key string, current uint64) string {
+	if current == 0 {
+		return fmt.Sprintf("Key '%s' does not exist. Set it without --if-revision, or with --if-revision 0", key)
+	}
+	return fmt.Sprintf("Key '%s' has changed; it is at revision %d. Look at it again with: nd kv get %s", key, current, key)
+}
+
+// failureReply builds an unsuccessful reply with the given message
+func failureReply(message string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"success": false,
+		"message": message,
+	})
+	return data
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	locksBucket       = "LOCKS"
+	lockResourceMax   = 256  // Longest lockable resource name
+	defaultLockTTLMax = 3600 // Longest lease in seconds
+)
+
+// lockTTLMax is the longest lease an agent may take on a resource, in
+// seconds (config: lock-ttl-max)
+var lockTTLMax = defaultLockTTLMax
+
+// Lock is the lease on a resource. Released and expired leases are kept, so
+// that the next holder gets a higher fencing token than every one before.
+type Lock struct {
+	Resource   string `json:"resource"`
+	Holder     string `json:"holder,omitempty"` // Empty once released
+	Token      uint64 `json:"token"`
+	AcquiredAt int64  `json:"acquired_at,omitempty"`
+	ExpiresAt  int64  `json:"expires_at,omitempty"`
+}
+
+// heldBy reports whether the lease is taken at now, and by whom
+func (l Lock) heldBy(now time.Time) string {
+	if l.Holder == "" || now.Unix() > l.ExpiresAt {
+		return ""
+	}
+	return l.Holder
+}
+
+// lockKey is the bucket key of a resource. Resources are usually file paths,
+// which may contain characters keys cannot, so they are encoded.
+func lockKey(resource string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(resource))
+}
+
+// setupLocks creates the key-value bucket holding the leases on resources
+func setupLocks(js nats.JetStreamContext) error {
+	_, err := js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:      locksBucket,
+		Description: "Leases agents hold on files and resources",
+		History:     1,
+		Storage:     nats.FileStorage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create lock store: %w", err)
+	}
+	return nil
+}
+
+// validateLockRequest checks the fields of a lock request
+func validateLockRequest(req map[string]interface{}) *fieldError {
+	op, fe := stringField(req, "op")
+	if fe != nil {
+		return fe
+	}
+	if op != "acquire" && op != "release" {
+		return &fieldError{Code: errInvalidValue, Field: "op", message: fmt.Sprintf("Unknown lock operation '%s' (use acquire or release)", op)}
+	}
+
+	resource, fe := boundedField(req, "resource", lockResourceMax)
+	if fe != nil {
+		return fe
+	}
+	if resource == "" {
+		return &fieldError{Code: errRequired, Field: "resource", message: "A resource is required, e.g. a file path"}
+	}
+
+	if op == "acquire" {
+		ttl, ok := req["ttl_seconds"].(float64)
+		if !ok {
+			return &fieldError{Code: errInvalidType, Field: "ttl_seconds", message: "Field ttl_seconds must be a number of seconds"}
+		}
+		if ttl < 1 || ttl > float64(lockTTLMax) {
+			return &fieldError{Code: errInvalidValue, Field: "ttl_seconds", Limit: lockTTLMax, message: fmt.Sprintf("A lease must last between 1 and %d seconds. Renew it by acquiring the lock again", lockTTLMax)}
+		}
+	}
+	return nil
+}
+
+// handleLock acquires or releases the lease on a resource on behalf of an
+// agent. Acquiring a lock the agent already holds renews its lease and
+// keeps its fencing token; acquiring a released or expired one hands out
+// the next token.
+func handleLock(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	now := time.Now()
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, now)
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	if fe := validateLockRequest(req); fe != nil {
+		respondFieldError(msg, fe)
+		return
+	}
+	op, _ := req["op"].(string)
+	resource, _ := req["resource"].(string)
+	ttl, _ := req["ttl_seconds"].(float64)
+
+	js, _ := nc.JetStream()
+	kv, err := js.KeyValue(locksBucket)
+	if err != nil {
+		log.Printf("Lock store unavailable: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error opening lock store"}`))
+		return
+	}
+
+	key := lockKey(resource)
+	lock := Lock{Resource: resource}
+	var revision uint64
+	entry, err := kv.Get(key)
+	switch {
+	case errors.Is(err, nats.ErrKeyNotFound):
+		// Never locked before
+	case err != nil:
+		log.Printf("Lock store read failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error reading lock store"}`))
+		return
+	default:
+		_ = json.Unmarshal(entry.Value(), &lock)
+		revision = entry.Revision()
+	}
+
+	holder := lock.heldBy(now)
+	var text string
+	if op == "acquire" {
+		if holder != "" && holder != agentName {
+			respondFieldError(msg, &fieldError{Code: errLocked, Field: "resource", message: fmt.Sprintf("%s is locked by %s for another %s. Wait for it with: nd lock wait %s", resource, holder, time.Unix(lock.ExpiresAt, 0).Sub(now).Round(time.Second), resource)})
+			return
+		}
+		if holder == "" {
+			lock.Token++
+			lock.AcquiredAt = now.Unix()
+		}
+		lock.Holder = agentName
+		lock.ExpiresAt = now.Add(time.Duration(ttl) * time.Second).Unix()
+		text = fmt.Sprintf("Locked %s (token %d) for %s", resource, lock.Token, time.Duration(ttl)*time.Second)
+		if holder == agentName {
+			text = fmt.Sprintf("Renewed the lock on %s (token %d) for %s", resource, lock.Token, time.Duration(ttl)*time.Second)
+		}
+	} else {
+		if holder == "" && lock.Holder != agentName {
+			_ = msg.Respond(failureReply(fmt.Sprintf("%s is not locked", resource)))
+			return
+		}
+		if lock.Holder != agentName {
+			_ = msg.Respond(failureReply(fmt.Sprintf("%s is locked by %s, not you", resource, lock.Holder)))
+			return
+		}
+		lock.Holder, lock.AcquiredAt, lock.ExpiresAt = "", 0, 0
+		text = fmt.Sprintf("Released %s", resource)
+	}
+
+	// The write is conditional on the revision read above, so two agents
+	// racing for the same resource cannot both get it
+	data, _ := json.Marshal(lock)
+	if revision == 0 {
+		_, err = kv.Create(key, data)
+	} else {
+		_, err = kv.Update(key, data, revision)
+	}
+	if err != nil {
+		if latest, getErr := kv.Get(key); getErr == nil && latest.Revision() != revision {
+			respondFieldError(msg, &fieldError{Code: errLocked, Field: "resource", message: fmt.Sprintf("%s was just locked by another agent. Wait for it with: nd lock wait %s", resource, resource)})
+			return
+		}
+		log.Printf("Lock store write failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error writing lock store"}`))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success":  true,
+		"message":  text,
+		"resource": resource,
+		"token":    lock.Token,
+	}
+	if op == "acquire" {
+		resp["holder"] = lock.Holder
+		resp["acquired_at"] = lock.AcquiredAt
+		resp["expires_at"] = lock.ExpiresAt
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+	fmt.Printf("ndadm: Agent '%s' %sd the lock on '%s'\n", agentName, op, resource)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// mailboxConsumerName returns the durable consumer name backing an agent's mailbox
+func mailboxConsumerName(agentName string) string {
+	return fmt.Sprintf("AGENT_%s", agentToken(agentName))
+}
+
+// Metadata keys recording on a mailbox consumer what its agent subscribed to,
+// so its filters can be rebuilt when message types are added
+const (
+	typesMetadata = "needy.types" // Comma separated, empty for all types
+	mineMetadata  = "needy.mine"  // "true" or "false"
+)
+
+// mailboxConfig returns the consumer configuration for an agent's mailbox,
+// delivering every broadcast and the agent's direct messages from the start
+// of the stream
+func mailboxConfig(agentName string) *nats.ConsumerConfig {
+	return &nats.ConsumerConfig{
+		Durable:        mailboxConsumerName(agentName),
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		FilterSubjects: mailboxFilters(agentName, nil, false),
+		Metadata:       map[string]string{typesMetadata: "", mineMetadata: "false"},
+	}
+}
+
+// ensureMailbox creates the agent's durable consumer if it does not exist yet.
+// An existing mailbox has its filters rebuilt from what its agent subscribed
+// to whenever they differ, so message types added since reach it, and
+// mailboxes from before messages had per-type subjects stop receiving other
+// agents' direct messages.
+func ensureMailbox(js nats.JetStreamContext, agentName string) (*nats.ConsumerInfo, error) {
+	info, err := js.ConsumerInfo(messageStream, mailboxConsumerName(agentName))
+	if err == nats.ErrConsumerNotFound {
+		info, err = js.AddConsumer(messageStream, mailboxConfig(agentName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create mailbox: %w", err)
+		}
+		return info, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to look up mailbox: %w", err)
+	}
+
+	types, mine := mailboxChoice(info.Config)
+	filters := mailboxFilters(agentName, types, mine)
+	_, recorded := info.Config.Metadata[mineMetadata]
+	if !recorded || info.Config.FilterSubject != "" || !sameFilters(info.Config.FilterSubjects, filters) {
+		info, err = filterMailbox(js, info, agentName, types, mine)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// mailboxChoice returns the message types (nil for all) and mine flag an
+// agent subscribed its mailbox to. Mailboxes from before the choice was
+// recorded have it read back from their filters, where every type that
+// existed when filters were introduced means all of them.
+func mailboxChoice(cfg nats.ConsumerConfig) ([]string, bool) {
+	if mine, ok := cfg.Metadata[mineMetadata]; ok {
+		var types []string
+		if recorded := cfg.Metadata[typesMetadata]; recorded != "" {
+			types = strings.Split(recorded, ",")
+		}
+		return types, mine == "true"
+	}
+
+	var types []string
+	mine := false
+	for _, filter := range cfg.FilterSubjects {
+		tokens := strings.Split(strings.TrimPrefix(filter, messageSubj+"."), ".")
+		if tokens[0] == ">" {
+			return nil, false
+		}
+		if !isMessageType(tokens[0]) {
+			continue
+		}
+		types = append(types, tokens[0])
+		if isReplyType(tokens[0]) && len(tokens) == 3 && tokens[1] == "*" {
+			mine = true
+		}
+	}
+	if len(types) == 0 || (slices.Contains(types, "need") && slices.Contains(types, "intent") && slices.Contains(types, "solution")) {
+		types = nil
+	}
+	return types, mine
+}
+
+// sameFilters reports whether two sets of filter subjects are the same,
+// whatever their order
+func sameFilters(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, filter := range a {
+		if !slices.Contains(b, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// filterMailbox rebuilds the filter subjects of an existing mailbox for the
+// given types (nil for all) and mine flag, keeping its position, and records
+// the choice on it
+func filterMailbox(js nats.JetStreamContext, info *nats.ConsumerInfo, agentName string, types []string, mine bool) (*nats.ConsumerInfo, error) {
+	cfg := info.Config
+	cfg.FilterSubject = ""
+	cfg.FilterSubjects = mailboxFilters(agentName, types, mine)
+	cfg.Metadata = make(map[string]string, len(info.Config.Metadata)+2)
+	for key, value := range info.Config.Metadata {
+		cfg.Metadata[key] = value
+	}
+	cfg.Metadata[typesMetadata] = strings.Join(types, ",")
+	cfg.Metadata[mineMetadata] = fmt.Sprintf("%t", mine)
+	updated, err := js.UpdateConsumer(messageStream, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update mailbox filters: %w", err)
+	}
+	registry.ChangeMailbox(agentName)
+	return updated, nil
+}
+
+// openMailbox binds a pull subscription to the agent's durable consumer,
+// creating the consumer on first use. The consumer is created explicitly
+// rather than by PullSubscribe so that unsubscribing never deletes it.
+func openMailbox(js nats.JetStreamContext, agentName string) (*nats.Subscription, error) {
+	info, err := ensureMailbox(js, agentName)
+	if err != nil {
+		return nil, err
+	}
+	return js.PullSubscribe(info.Config.FilterSubject, info.Name, nats.Bind(messageStream, info.Name))
+}
+
+// peekMailbox returns up to batch unread messages without moving the agent's
+// mailbox position. It reads through a short-lived consumer that starts just
+// after the last message the agent acknowledged, or after the given sequence
+// if that is further on, and shares its filters.
+func peekMailbox(js nats.JetStreamContext, agentName string, batch int, after uint64, wait time.Duration) ([]*nats.Msg, error) {
+	info, err := ensureMailbox(js, agentName)
+	if err != nil {
+		return nil, err
+	}
+
+	start := max(info.AckFloor.Stream, after) + 1
+	sub, closeReader, err := openReader(js, start, info.Config.FilterSubject, info.Config.FilterSubjects)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+
+	// Messages read ahead of the ack floor are no longer waiting
+	readAhead := registry.ReadAhead(agentName, info.AckFloor.Stream)
+	msgs, err := fetchMailbox(sub, batch+len(readAhead), wait)
+	if err != nil {
+		return nil, err
+	}
+	waiting := msgs[:0]
+	for _, m := range msgs {
+		if meta, err := m.Metadata(); err == nil && readAhead[meta.Sequence.Stream] {
+			continue
+		}
+		waiting = append(waiting, m)
+	}
+	return waiting[:min(len(waiting), batch)], nil
+}
+
+// settleMailbox acknowledges the messages an agent has read and returns
+// the rest to its mailbox. Read messages that overtook one put back are
+// remembered, so a peek does not show them again. Both wait for the server,
+// so the mailbox counts read afterwards are up to date.
+func settleMailbox(agentName string, read, putBack []*nats.Msg) {
+	first := uint64(0)
+	for _, m := range putBack {
+		_ = m.Nak(nats.AckWait(settleTimeout))
+		if meta, err := m.Metadata(); err == nil && (first == 0 || meta.Sequence.Stream < first) {
+			first = meta.Sequence.Stream
+		}
+	}
+
+	var ahead []uint64
+	for _, m := range read {
+		_ = m.AckSync()
+		if meta, err := m.Metadata(); err == nil && first > 0 && meta.Sequence.Stream > first {
+			ahead = append(ahead, meta.Sequence.Stream)
+		}
+	}
+	if len(ahead) > 0 {
+		registry.MarkReadAhead(agentName, ahead)
+	}
+}
+
+// rewindMailbox repositions the agent's mailbox so that delivery restarts at
+// the given stream sequence, or at the first message stored since the given
+// time when seq is zero. JetStream cannot move an existing consumer, so the
+// consumer is recreated with the same name and filters; the caller holds the
+// agent's mailbox exclusively so no read sees it missing in between.
+func rewindMailbox(js nats.JetStreamContext, agentName string, seq uint64, since time.Time) error {
+	info, err := ensureMailbox(js, agentName)
+	if err != nil {
+		return err
+	}
+
+	cfg := info.Config
+	cfg.OptStartSeq = 0
+	cfg.OptStartTime = nil
+	if seq > 0 {
+		cfg.DeliverPolicy = nats.DeliverByStartSequencePolicy
+		cfg.OptStartSeq = seq
+	} else {
+		cfg.DeliverPolicy = nats.DeliverByStartTimePolicy
+		cfg.OptStartTime = &since
+	}
+
+	if err := js.DeleteConsumer(messageStream, cfg.Durable); err != nil {
+		return fmt.Errorf("failed to reset mailbox: %w", err)
+	}
+	if _, err := js.AddConsumer(messageStream, &cfg); err != nil {
+		return fmt.Errorf("failed to reset mailbox: %w", err)
+	}
+	// The new consumer delivers from the start again, read or not
+	registry.ForgetReadAhead(agentName)
+	registry.ChangeMailbox(agentName)
+	return nil
+}
+
+// settleTimeout is how long settling waits for the server to confirm that a
+// message was handed back
+const settleTimeout = 5 * time.Second
+
+// mailboxPoll is the longest an operation holds an agent's mailbox while it
+// waits for messages. Longer waits are split into turns of this length.
+const mailboxPoll = time.Second
+
+// fetchMailbox waits up to wait for at most batch messages from the mailbox.
+// Messages are returned unacknowledged so the caller decides when delivery
+// is complete; an empty result on timeout is not an error.
+func fetchMailbox(sub *nats.Subscription, batch int, wait time.Duration) ([]*nats.Msg, error) {
+	msgs, err := sub.Fetch(batch, nats.MaxWait(wait))
+	if err == nats.ErrTimeout {
+		return msgs, nil
+	}
+	return msgs, err
+}
+
+// mailboxEntry converts a stored stream message into the representation sent to agents
+func mailboxEntry(m *nats.Msg) map[string]interface{} {
+	var payload Message
+	_ = json.Unmarshal(m.Data, &payload)
+
+	meta, _ := m.Metadata()
+	seq := uint64(0)
+	if meta != nil {
+		seq = meta.Sequence.Stream
+	}
+
+	return map[string]interface{}{
+		"id":           fmt.Sprintf("%d", seq), // Use JetStream sequence as ID
+		"type":         payload.Type,
+		"sender":       payload.Sender,
+		"text":         payload.Text,
+		"data":         payload.Data,
+		"data_ref":     payload.DataRef,
+		"data_size":    payload.DataSize,
+		"content_type": payload.ContentType,
+		"encoding":     payload.Encoding,
+		"attachments":  payload.Attachments,
+		"need_id":      payload.NeedID,
+		"recipient":    payload.Recipient,
+		"priority":     payload.Priority,
+		"deadline":     payload.Deadline,
+		"parent":       payload.Parent,
+		"depends_on":   payload.DependsOn,
+		"skills":       payload.Skills,
+		"routed_to":    payload.RoutedTo,
+		"paths":        payload.Paths,
+		"timestamp":    payload.Timestamp,
+	}
+}
+
+// stubEntry cuts an entry too large for a read reply down to what
+// identifies it. The full message is still there for nd get.
+func stubEntry(entry map[string]interface{}) map[string]interface{} {
+	stub := map[string]interface{}{"truncated": true}
+	for _, field := range []string{"id", "type", "sender", "need_id", "recipient", "data_ref", "data_size", "content_type", "timestamp"} {
+		stub[field] = entry[field]
+	}
+	return stub
+}
+
+// mailboxPending returns how many messages are still waiting in the mailbox,
+// counting both undelivered ones and ones handed out but not yet
+// acknowledged. Undelivered needs routed to other agents, which reads pass
+// over, are not counted; who a need reaches is recorded when it is sent.
+func mailboxPending(js nats.JetStreamContext, agentName string) uint64 {
+	info, err := js.ConsumerInfo(messageStream, mailboxConsumerName(agentName))
+	if err != nil {
+		return 0
+	}
+	pending := info.NumPending + uint64(info.NumAckPending)
+	if info.NumPending == 0 || !receivesNeeds(info.Config) {
+		return pending
+	}
+	return pending - min(pending, registry.RoutedAway(agentName, info.Delivered.Stream))
+}
+
+// receivesNeeds reports whether a mailbox's filters let needs through
+func receivesNeeds(cfg nats.ConsumerConfig) bool {
+	for _, filter := range cfg.FilterSubjects {
+		if strings.HasPrefix(filter, messageSubj+".need.") {
+			return true
+		}
+	}
+	return false
+}
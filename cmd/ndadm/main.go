@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -21,6 +22,9 @@ const (
 	registrationSubj = "needy.register"
 	messageStream    = "MESSAGES"
 	messageSubj      = "needy.messages"
+	defaultFetch     = 10   // Messages per read when the agent does not ask for a number
+	defaultMaxFetch  = 100  // Upper bound on messages per read
+	replyOverhead    = 1024 // Room left in a reply for everything but the messages
 )
 
 func readConfig() map[string]string {
@@ -43,31 +47,55 @@ func readConfig() map[string]string {
 	return cfg
 }
 
-func getPort() int {
+// getConfigInt returns an integer setting from the config file, or def if it is not set
+func getConfigInt(key string, def int) int {
 	cfg := readConfig()
-	port := defaultPort
-	if p, ok := cfg["port"]; ok {
-		_, _ = fmt.Sscanf(p, "%d", &port)
+	value := def
+	if v, ok := cfg[key]; ok {
+		_, _ = fmt.Sscanf(v, "%d", &value)
 	}
-	return port
+	return value
+}
+
+func getPort() int {
+	return getConfigInt("port", defaultPort)
 }
 
 type RegistrationRequest struct {
-	AgentName string `json:"agent_name"`
-	ClientID  string `json:"client_id"`
+	AgentName string         `json:"agent_name"`
+	ClientID  string         `json:"client_id"`
+	Profile   *ProfileUpdate `json:"profile,omitempty"` // Changes to the agent's profile, if any
 }
 
 type RegistrationResponse struct {
-	Success      bool   `json:"success"`
-	Message      string `json:"message"`
-	IsReregister bool   `json:"is_reregister"`
+	Success      bool        `json:"success"`
+	Message      string      `json:"message"`
+	IsReregister bool        `json:"is_reregister"`
+	Error        *fieldError `json:"error,omitempty"`
 }
 
 // Global registry instance
 var registry = NewRegistry()
 
+// maxFetch caps how many messages a single read may return (config: max-fetch)
+var maxFetch = defaultMaxFetch
+
 func main() {
 	natsPort := getPort()
+	maxFetch = getConfigInt("max-fetch", defaultMaxFetch)
+	inlinePayload = getConfigInt("payload-inline-max", defaultInlinePayload)
+	maxPayloadSize = getConfigInt("payload-max", defaultMaxPayloadSize)
+	payloadStoreSize = getConfigInt("payload-store-max", defaultPayloadStore)
+	textMax = getConfigInt("text-max", defaultTextMax)
+	idMax = getConfigInt("id-max", defaultIDMax)
+	attachmentsMax = getConfigInt("attachments-max", defaultAttachmentsMax)
+	nameMax = getConfigInt("name-max", defaultNameMax)
+	highPriorityPerHour = getConfigInt("high-priority-per-hour", defaultHighPriorityPerHour)
+	deadlineReminder = getConfigInt("deadline-reminder", defaultDeadlineReminder)
+	presenceOnline = getConfigInt("presence-online", defaultPresenceOnline)
+	presenceIdle = getConfigInt("presence-idle", defaultPresenceIdle)
+	kvValueMax = getConfigInt("kv-value-max", defaultKVValueMax)
+	lockTTLMax = getConfigInt("lock-ttl-max", defaultLockTTLMax)
 
 	// Start embedded NATS server with JetStream
 	opts := &server.Options{
@@ -117,13 +145,90 @@ func main() {
 	}
 
 	// Subscribe to read requests
+	// Reads may long-poll, so each one gets its own goroutine to keep
+	// a waiting agent from blocking everyone else's mailbox
 	_, err = nc.Subscribe("needy.read", func(msg *nats.Msg) {
-		handleRead(nc, msg)
+		go handleRead(nc, msg)
 	})
 	if err != nil {
 		log.Fatalf("Failed to subscribe to read: %v", err)
 	}
 
+	// Subscribe to watch requests
+	_, err = nc.Subscribe("needy.watch", func(msg *nats.Msg) {
+		handleWatch(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to watch: %v", err)
+	}
+
+	// Subscribe to settle requests
+	_, err = nc.Subscribe("needy.settle", func(msg *nats.Msg) {
+		handleSettle(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to settle: %v", err)
+	}
+
+	// Subscribe to rewind requests
+	_, err = nc.Subscribe("needy.rewind", func(msg *nats.Msg) {
+		handleRewind(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to rewind: %v", err)
+	}
+
+	// Subscribe to solution waits
+	// Like reads, waits long-poll and get their own goroutine
+	_, err = nc.Subscribe("needy.await", func(msg *nats.Msg) {
+		go handleAwait(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to await: %v", err)
+	}
+
+	// Subscribe to mailbox filter changes
+	_, err = nc.Subscribe("needy.subscribe", func(msg *nats.Msg) {
+		handleSubscribe(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to subscribe: %v", err)
+	}
+
+	// Subscribe to profile updates
+	_, err = nc.Subscribe("needy.profile", handleProfile)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to profile: %v", err)
+	}
+
+	// Subscribe to agent directory requests
+	_, err = nc.Subscribe("needy.agents", handleAgents)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to agents: %v", err)
+	}
+
+	// Subscribe to heartbeats
+	_, err = nc.Subscribe("needy.heartbeat", handleHeartbeat)
+	if err != nil {
+		log.Fatalf("Failed to subscribe to heartbeat: %v", err)
+	}
+
+	// Subscribe to scratchpad writes
+	_, err = nc.Subscribe("needy.kv", func(msg *nats.Msg) {
+		handleKV(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to kv: %v", err)
+	}
+
+	// Subscribe to lock requests
+	_, err = nc.Subscribe("needy.lock", func(msg *nats.Msg) {
+		handleLock(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to lock: %v", err)
+	}
+
 	// Subscribe to get requests
 	_, err = nc.Subscribe("needy.get", func(msg *nats.Msg) {
 		handleGet(nc, msg)
@@ -132,6 +237,48 @@ func main() {
 		log.Fatalf("Failed to subscribe to get: %v", err)
 	}
 
+	// Subscribe to thread requests
+	_, err = nc.Subscribe("needy.thread", func(msg *nats.Msg) {
+		handleThread(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to thread: %v", err)
+	}
+
+	// Subscribe to sent message listings
+	_, err = nc.Subscribe("needy.history", func(msg *nats.Msg) {
+		handleHistory(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to history: %v", err)
+	}
+
+	// Subscribe to open need listings
+	_, err = nc.Subscribe("needy.needs", func(msg *nats.Msg) {
+		handleNeeds(nc, msg)
+	})
+	if err != nil {
+		log.Fatalf("Failed to subscribe to needs: %v", err)
+	}
+
+	// Remind agents of approaching deadlines and tell owners of missed ones,
+	// including those of needs sent before a restart, and recall who the
+	// routed needs sent before it reach
+	if js, err := nc.JetStream(); err == nil {
+		if err := restoreDeadlines(js); err != nil {
+			log.Printf("Failed to restore deadlines: %v", err)
+		}
+		if err := restoreRoutes(js); err != nil {
+			log.Printf("Failed to restore routes: %v", err)
+		}
+	}
+	go watchDeadlines(nc)
+
+	// Optional HTTP push endpoint for watchers that do not speak NATS
+	if httpPort := getConfigInt("http-port", 0); httpPort > 0 {
+		startHTTPServer(nc, httpPort)
+	}
+
 	fmt.Println("ndadm: Listening for agent registrations...")
 
 	// Wait for interrupt signal
@@ -152,7 +299,26 @@ func handleRegistration(msg *nats.Msg) {
 		return
 	}
 
+	// Names become part of subjects and consumer names, so only names that
+	// agentToken can map safely are accepted
+	if fe := validateAgentName(req.AgentName); fe != nil {
+		respData, _ := json.Marshal(RegistrationResponse{Message: fe.message, Error: fe})
+		_ = msg.Respond(respData)
+		return
+	}
+
+	if req.Profile != nil {
+		if fe := req.Profile.validate(); fe != nil {
+			respData, _ := json.Marshal(RegistrationResponse{Message: fe.message, Error: fe})
+			_ = msg.Respond(respData)
+			return
+		}
+	}
+
 	success, message, isReregister := registry.RegisterAgent(req.AgentName, req.ClientID)
+	if success && req.Profile != nil {
+		registry.UpdateProfile(req.AgentName, *req.Profile)
+	}
 
 	if success && !isReregister {
 		fmt.Printf("ndadm: Registered agent '%s' with client ID %s\n", req.AgentName, req.ClientID)
@@ -177,31 +343,93 @@ func handleSend(nc *nats.Conn, msg *nats.Msg) {
 	}
 
 	clientID, _ := req["client_id"].(string)
-	agentName := registry.GetAgentName(clientID)
+	agentName := registry.CheckIn(clientID, time.Now())
 	if agentName == "" {
 		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
 		return
 	}
 
+	// Every field is checked here; clients may talk to the network directly
+	if fe := validateSendRequest(req); fe != nil {
+		respondFieldError(msg, fe)
+		return
+	}
+
 	js, _ := nc.JetStream()
 
-	// Validate Intent logic
 	msgType, _ := req["type"].(string)
+	text, _ := req["text"].(string)
 	needID, _ := req["need_id"].(string)
 
-	if msgType == "intent" {
-		if needID != "" {
-			registry.RecordIntent(agentName, needID)
+	// Direct messages must name a registered recipient
+	recipient, _ := req["recipient"].(string)
+	if msgType == "dm" {
+		if !registry.IsRegistered(recipient) {
+			resp := map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Unknown agent '%s'", recipient),
+			}
+			respData, _ := json.Marshal(resp)
+			_ = msg.Respond(respData)
+			return
 		}
+	} else {
+		recipient = ""
+	}
+
+	if msgType == "intent" {
+		registry.RecordIntent(agentName, needID)
 	}
 
 	if msgType == "solution" {
-		if needID == "" {
-			_ = msg.Respond([]byte(`{"success": false, "message": "Solution must provide need_id"}`))
+		if !registry.HasIntent(agentName, needID) {
+			_ = msg.Respond([]byte(`{"success": false, "message": "You must first announce intent to respond"}`))
+			return
+		}
+		blockers, err := blockingNeeds(js, needID)
+		if err != nil {
+			log.Printf("Dependency check failed: %v", err)
+			_ = msg.Respond([]byte(`{"success": false, "message": "Internal error checking dependencies"}`))
 			return
 		}
+		if len(blockers) > 0 {
+			_ = msg.Respond(failureReply(blockedMessage(needID, blockers)))
+			return
+		}
+	}
+
+	// Replies carry the owner of their need in the subject so that agents
+	// can filter for answers to their own needs; direct messages carry
+	// their recipient
+	target := recipient
+	if isReplyType(msgType) {
+		target = needOwner(js, needID)
+	}
+
+	// Questions, progress and withdrawals come from agents working on the
+	// need, answers and cancels from the agent that owns it
+	switch msgType {
+	case "question", "progress", "withdraw":
 		if !registry.HasIntent(agentName, needID) {
-			_ = msg.Respond([]byte(`{"success": false, "message": "You must first announce intent to respond"}`))
+			_ = msg.Respond([]byte(`{"success": false, "message": "You must first announce intent on the need: nd send intent <need-id>"}`))
+			return
+		}
+	case "answer":
+		if target == "" {
+			_ = msg.Respond([]byte(`{"success": false, "message": "Answer must provide the ID of an existing need"}`))
+			return
+		}
+		if target != agentName {
+			_ = msg.Respond([]byte(`{"success": false, "message": "Only the owner of the need can answer questions about it"}`))
+			return
+		}
+	case "cancel":
+		if target == "" {
+			_ = msg.Respond([]byte(`{"success": false, "message": "Cancel must provide the ID of an existing need"}`))
+			return
+		}
+		if target != agentName {
+			_ = msg.Respond([]byte(`{"success": false, "message": "Only the owner of the need can stop waiting for it"}`))
 			return
 		}
 	}
@@ -209,26 +437,120 @@ func handleSend(nc *nats.Conn, msg *nats.Msg) {
 	newMsg := Message{
 		Type:      msgType,
 		Sender:    agentName,
-		Text:      req["text"].(string),
+		Text:      text,
 		NeedID:    needID,
+		Recipient: recipient,
 		Timestamp: makeTimestamp(),
 	}
 	if d, ok := req["data"].(string); ok {
 		newMsg.Data = d
 	}
 
+	// Needs asking for skills go only to agents advertising one of them
+	if msgType == "need" {
+		newMsg.Skills, _ = skillsField(req, "skills")
+		newMsg.RoutedTo = routeNeed(agentName, newMsg.Skills)
+		if p, _ := req["priority"].(string); p != priorityNormal {
+			newMsg.Priority = p
+		}
+		if newMsg.Priority == priorityHigh {
+			if wait := registry.HighPriorityWait(agentName, highPriorityPerHour, time.Now()); wait > 0 {
+				respondFieldError(msg, &fieldError{Code: errRateLimited, Field: "priority", Limit: highPriorityPerHour, message: fmt.Sprintf("Too many high-priority needs (max %d per hour). Send this one as normal priority, or try again in %s", highPriorityPerHour, wait.Round(time.Minute))})
+				return
+			}
+		}
+		if d, ok := req["deadline"].(float64); ok {
+			newMsg.Deadline = int64(d)
+		}
+
+		// Sub-needs and dependencies can only name needs stored before
+		// this one, which keeps the graph of needs free of cycles
+		newMsg.Parent, newMsg.DependsOn = needLinks(req)
+		for _, id := range append([]string{newMsg.Parent}, newMsg.DependsOn...) {
+			if id != "" && needOwner(js, id) == "" {
+				_ = msg.Respond(failureReply(fmt.Sprintf("Need %s not found. See the open needs with: nd needs", id)))
+				return
+			}
+		}
+	}
+	if msgType == "intent" {
+		newMsg.Paths, _ = pathsField(req, "paths")
+	}
+
+	// Large payloads and attachments live in the object store and are
+	// referenced from the message. The inline limit never exceeds what
+	// fits in one stream message.
+	inlineLimit := min(inlinePayload, int(nc.MaxPayload())-replyOverhead)
+	if problem := preparePayload(js, req, &newMsg, inlineLimit); problem != "" {
+		resp := map[string]interface{}{
+			"success": false,
+			"message": problem,
+		}
+		respData, _ := json.Marshal(resp)
+		_ = msg.Respond(respData)
+		return
+	}
+
 	msgData, _ := json.Marshal(newMsg)
 
 	// Publish to stream
-	// We publish to the subject tracked by the stream
-	_, err := js.Publish(messageSubj, msgData)
+	ack, err := js.Publish(messageSubject(msgType, agentName, target), msgData)
 	if err != nil {
 		log.Printf("Failed to publish message: %v", err)
 		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error storing message"}`))
 		return
 	}
 
-	_ = msg.Respond([]byte(fmt.Sprintf(`{"success": true, "message": "Sent %s successfully"}`, msgType)))
+	if msgType == "withdraw" {
+		registry.WithdrawIntent(agentName, needID)
+	}
+	// Only needs that were actually sent use up the allowance
+	if newMsg.Priority == priorityHigh {
+		registry.TakeHighPriority(agentName, time.Now())
+	}
+
+	// Who a routed need reaches is settled now, so mailbox counts need not
+	// look at it again
+	if len(newMsg.RoutedTo) > 0 {
+		registry.RecordRoute(ack.Sequence, agentName, newMsg.RoutedTo)
+	}
+
+	// Needs with a deadline are watched until their first solution
+	if newMsg.Deadline > 0 {
+		sent, due := time.Unix(newMsg.Timestamp, 0), time.Unix(newMsg.Deadline, 0)
+		registry.TrackDeadline(fmt.Sprintf("%d", ack.Sequence), agentName, text, due, reminderLead(sent, due))
+	}
+	if msgType == "solution" {
+		registry.SettleDeadline(needID)
+		registry.ReleaseClaims(needID)
+	}
+
+	// Both parties hear of intents claiming overlapping paths: the sender
+	// in the response, the others by a conflict message
+	var conflicts []PathConflict
+	if len(newMsg.Paths) > 0 {
+		conflicts = registry.ClaimPaths(agentName, needID, newMsg.Paths)
+		for _, c := range conflicts {
+			publishConflict(js, agentName, needID, newMsg.Paths, c)
+		}
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"id":      fmt.Sprintf("%d", ack.Sequence),
+		"message": fmt.Sprintf("Sent %s successfully", msgType),
+	}
+	if len(newMsg.Skills) > 0 {
+		resp["routed_to"] = routedAgents(newMsg.RoutedTo)
+	}
+	if len(conflicts) > 0 {
+		resp["conflicts"] = conflicts
+	}
+	if msgType == "need" && othersOnline(agentName, time.Now()) == 0 {
+		resp["warning"] = "No other agent is online right now, so it may be a while before anyone sees this need. Check who is around with: nd agents"
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
 	fmt.Printf("ndadm: Agent '%s' sent %s\n", agentName, msgType)
 }
 
@@ -240,7 +562,7 @@ func handleRead(nc *nats.Conn, msg *nats.Msg) {
 	}
 
 	clientID, _ := req["client_id"].(string)
-	agentName := registry.GetAgentName(clientID)
+	agentName := registry.CheckIn(clientID, time.Now())
 	if agentName == "" {
 		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
 		return
@@ -248,58 +570,192 @@ func handleRead(nc *nats.Conn, msg *nats.Msg) {
 
 	js, _ := nc.JetStream()
 
-	// Create durable consumer name based on agent name
-	consumerName := fmt.Sprintf("AGENT_%s", agentName)
-
-	// Pull subscription
-	// We bind to the stream and use the durable name
-	// If it doesn't exist, we might need to create it or just subscribing creates it if we use Durable?
-	// With PullSubscribe, we should specify durable.
-	sub, err := js.PullSubscribe(messageSubj, consumerName, nats.BindStream(messageStream))
-	if err != nil {
-		log.Printf("Subscribe failed: %v", err)
-		_ = msg.Respond([]byte(`{"success": false, "message": "Mailbox error"}`))
-		return
-	}
-
 	// Fetch messages, using timeout from request if provided
 	waitDuration := 100 * time.Millisecond
 	if timeoutMs, ok := req["timeout_ms"].(float64); ok && timeoutMs > 0 {
 		waitDuration = time.Duration(timeoutMs) * time.Millisecond
 	}
-	msgs, _ := sub.Fetch(10, nats.MaxWait(waitDuration))
+	batch := defaultFetch
+	if n, ok := req["max"].(float64); ok {
+		if n < 1 {
+			_ = msg.Respond([]byte(`{"success": false, "message": "max must be a positive number"}`))
+			return
+		}
+		batch = int(n)
+	}
+	if batch > maxFetch {
+		batch = maxFetch
+	}
+
+	// A peek reads the same messages without acknowledging them, and may
+	// continue after the last message an earlier peek returned
+	peek, _ := req["peek"].(bool)
+	var after uint64
+	if n, ok := req["after"].(float64); ok && n > 0 {
+		after = uint64(n)
+	}
+
+	// The wait is spent in short turns holding the mailbox, so a long poll
+	// never keeps a rewind of the same mailbox waiting
+	deadline := time.Now().Add(waitDuration)
+	for {
+		wait := max(min(time.Until(deadline), mailboxPoll), 100*time.Millisecond)
+		unlock := registry.ShareMailbox(agentName)
+		responseMsgs, pending, err := readBatch(nc, js, agentName, batch, peek, after, wait)
+		unlock()
+		if err != nil {
+			log.Printf("Mailbox read failed: %v", err)
+			_ = msg.Respond([]byte(`{"success": false, "message": "Mailbox error"}`))
+			return
+		}
+		if len(responseMsgs) == 0 && time.Now().Before(deadline) {
+			continue
+		}
 
-	responseMsgs := []map[string]interface{}{}
+		resp := map[string]interface{}{
+			"success":  true,
+			"messages": responseMsgs,
+			"pending":  pending,
+		}
+		respData, _ := json.Marshal(resp)
+		_ = msg.Respond(respData)
+		return
+	}
+}
 
+// readBatch reads up to batch messages from the agent's mailbox, waiting up
+// to wait for them, and returns their entries together with how many
+// messages are left. A peek after a given sequence returns messages in stream
+// order, so the last one returned is where the next peek carries on. The
+// caller shares the agent's mailbox.
+func readBatch(nc *nats.Conn, js nats.JetStreamContext, agentName string, batch int, peek bool, after uint64, wait time.Duration) ([]map[string]interface{}, uint64, error) {
+	// Look a little past the batch so that urgent needs further back in the
+	// mailbox can jump the queue
+	window := min(batch+priorityLookahead, maxFetch)
+
+	var msgs []*nats.Msg
+	var sub *nats.Subscription
+	var err error
+	if peek {
+		msgs, err = peekMailbox(js, agentName, window, after, wait)
+	} else {
+		sub, err = openMailbox(js, agentName)
+		if err == nil {
+			defer func() { _ = sub.Unsubscribe() }()
+			msgs, err = fetchMailbox(sub, window, wait)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Needs routed to other agents are passed over before the batch is
+	// chosen, so they take no place in it
+	var read []*nats.Msg
+	routedFor := map[*nats.Msg][]string{}
+	wanted := msgs[:0]
 	for _, m := range msgs {
-		var payload Message
-		_ = json.Unmarshal(m.Data, &payload)
-
-		// Map for response
-		meta, _ := m.Metadata()
-		seq := uint64(0)
-		if meta != nil {
-			seq = meta.Sequence.Stream
+		skills, ok := routeFor(agentName, m)
+		if !ok {
+			read = append(read, m)
+			continue
 		}
+		if skills != nil {
+			routedFor[m] = skills
+		}
+		wanted = append(wanted, m)
+	}
+	msgs = wanted
 
-		rMsg := map[string]interface{}{
-			"id":        fmt.Sprintf("%d", seq), // Use JetStream sequence as ID
-			"type":      payload.Type,
-			"sender":    payload.Sender,
-			"text":      payload.Text,
-			"data":      payload.Data,
-			"timestamp": payload.Timestamp,
+	// Higher priorities first; what does not make the batch goes back to
+	// the mailbox for the next read
+	if after == 0 {
+		msgs = prioritize(js, msgs)
+	}
+	var putBack []*nats.Msg
+	if len(msgs) > batch {
+		msgs, putBack = msgs[:batch], msgs[batch:]
+	}
+
+	// Stop short of the connection's payload limit; anything that does not
+	// fit goes straight back to the mailbox for the next read. A first
+	// message too large for any reply is delivered as a stub.
+	responseMsgs := []map[string]interface{}{}
+	budget := int(nc.MaxPayload()) - replyOverhead
+	for i, m := range msgs {
+		entry := mailboxEntry(m)
+		if skills, ok := routedFor[m]; ok {
+			entry["routed_for"] = skills
+		}
+		entryData, _ := json.Marshal(entry)
+		budget -= len(entryData) + 1
+		if budget < 0 && i > 0 {
+			putBack = append(append([]*nats.Msg{}, msgs[i:]...), putBack...)
+			break
 		}
-		responseMsgs = append(responseMsgs, rMsg)
-		_ = m.Ack()
+		if budget < 0 {
+			entry = stubEntry(entry)
+		}
+		responseMsgs = append(responseMsgs, entry)
+		read = append(read, m)
+	}
+	if !peek {
+		settleMailbox(agentName, read, putBack)
+	}
+
+	// Counted once the mailbox has settled. A peek leaves what it returned
+	// unread, so only count what comes after it.
+	pending := mailboxPending(js, agentName)
+	if peek {
+		pending -= min(pending, uint64(len(responseMsgs)))
+	}
+	return responseMsgs, pending, nil
+}
+
+func handleRewind(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	toSeq, _ := req["to_seq"].(float64)
+	sinceMs, _ := req["since_ms"].(float64)
+	if toSeq < 1 && sinceMs <= 0 {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Rewind needs a message ID (--to) or a duration (--since)"}`))
+		return
 	}
 
+	js, _ := nc.JetStream()
+
+	since := time.Now().Add(-time.Duration(sinceMs) * time.Millisecond)
+	unlock := registry.LockMailbox(agentName)
+	defer unlock()
+	if err := rewindMailbox(js, agentName, uint64(toSeq), since); err != nil {
+		log.Printf("Rewind failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Mailbox error"}`))
+		return
+	}
+
+	text := fmt.Sprintf("Mailbox rewound to message %d", uint64(toSeq))
+	if toSeq < 1 {
+		text = fmt.Sprintf("Mailbox rewound to %s", since.Format(time.RFC3339))
+	}
 	resp := map[string]interface{}{
-		"success":  true,
-		"messages": responseMsgs,
+		"success": true,
+		"message": text,
+		"pending": mailboxPending(js, agentName),
 	}
 	respData, _ := json.Marshal(resp)
 	_ = msg.Respond(respData)
+	fmt.Printf("ndadm: Agent '%s' rewound their mailbox\n", agentName)
 }
 
 func handleGet(nc *nats.Conn, msg *nats.Msg) {
@@ -310,7 +766,7 @@ func handleGet(nc *nats.Conn, msg *nats.Msg) {
 	}
 
 	clientID, _ := req["client_id"].(string)
-	agentName := registry.GetAgentName(clientID)
+	agentName := registry.CheckIn(clientID, time.Now())
 	if agentName == "" {
 		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
 		return
@@ -338,6 +794,13 @@ func handleGet(nc *nats.Conn, msg *nats.Msg) {
 
 	var payload Message
 	_ = json.Unmarshal(m.Data, &payload)
+	payload.ID = fmt.Sprintf("%d", m.Sequence)
+
+	// Direct messages and deadline notices are only visible to the parties
+	if payload.Recipient != "" && agentName != payload.Sender && agentName != payload.Recipient {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Message not found"}`))
+		return
+	}
 
 	resp := map[string]interface{}{
 		"success": true,
@@ -354,13 +817,30 @@ func makeTimestamp() int64 {
 // Message types
 type Message struct {
 	ID        string `json:"id"`
-	Type      string `json:"type"` // "need", "intent", "solution"
+	Type      string `json:"type"` // "need", "intent", "withdraw", "solution", "question", "answer", "progress", "cancel", "dm", "reminder", "overdue", "conflict"
 	Sender    string `json:"sender"`
 	Text      string `json:"text"`
 	Data      string `json:"data,omitempty"`
-	NeedID    string `json:"need_id,omitempty"`   // For intent/solution
+	DataRef   string `json:"data_ref,omitempty"`  // Object store name when Data was too large to inline
+	DataSize  uint64 `json:"data_size,omitempty"` // Size of the referenced payload in bytes
+	NeedID    string `json:"need_id,omitempty"`   // For replies to a need
 	IntentID  string `json:"intent_id,omitempty"` // For solution
+	Recipient string `json:"recipient,omitempty"` // For dm, reminder, overdue and conflict
+	Deadline  int64  `json:"deadline,omitempty"`  // Unix time a need is due
+	Parent    string `json:"parent,omitempty"`    // Need a sub-need is part of
 	Timestamp int64  `json:"timestamp"`
+
+	ContentType string `json:"content_type,omitempty"` // Media type of the payload
+	Encoding    string `json:"encoding,omitempty"`     // "base64" when inline Data is binary
+
+	Priority string              `json:"priority,omitempty"`  // "high" or "low" for needs that are not normal
+	Skills   []string            `json:"skills,omitempty"`    // Skills a need asks for
+	RoutedTo map[string][]string `json:"routed_to,omitempty"` // Agents a need was routed to, with the skills they matched
+	Paths    []string            `json:"paths,omitempty"`     // Path globs an intent claims
+
+	DependsOn []string `json:"depends_on,omitempty"` // Needs to be solved before a need can be
+
+	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
 func setupJetStream(nc *nats.Conn) error {
@@ -369,16 +849,32 @@ func setupJetStream(nc *nats.Conn) error {
 		return fmt.Errorf("failed to get JetStream context: %w", err)
 	}
 
-	// Create or update the message stream
-	_, err = js.AddStream(&nats.StreamConfig{
+	// Create or update the message stream. Streams created before messages
+	// had per-type subjects are updated in place and keep the root subject,
+	// so the messages stored on it stay readable.
+	cfg := &nats.StreamConfig{
 		Name:     messageStream,
-		Subjects: []string{messageSubj},
+		Subjects: []string{messageSubj, allMessagesSubj},
 		Storage:  nats.FileStorage,
-	})
+	}
+	_, err = js.AddStream(cfg)
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		_, err = js.UpdateStream(cfg)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create stream: %w", err)
 	}
 
+	if err := setupPayloadStore(js); err != nil {
+		return err
+	}
+	if err := setupScratchpad(js); err != nil {
+		return err
+	}
+	if err := setupLocks(js); err != nil {
+		return err
+	}
+
 	fmt.Println("ndadm: JetStream message stream ready")
 	return nil
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultNameMax is the longest agent name accepted, in characters
+const defaultNameMax = 64
+
+// nameMax is the longest agent name accepted (config: name-max)
+var nameMax = defaultNameMax
+
+// plainName matches names that are safe to use as they are in subjects and
+// consumer names
+var plainName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateAgentName checks a name at registration. Names may use letters
+// and digits of any script, spaces, '.', '-' and '_', and must start and
+// end with a letter or digit. The server's own sender name is reserved, so
+// no agent can pass for it.
+func validateAgentName(name string) *fieldError {
+	if name == "" {
+		return &fieldError{Code: errRequired, Field: "agent_name", message: "Agent name is required"}
+	}
+	if utf8.RuneCountInString(name) > nameMax {
+		return &fieldError{Code: errTooLong, Field: "agent_name", Limit: nameMax, message: fmt.Sprintf("Agent name too long (max %d characters)", nameMax)}
+	}
+	invalid := &fieldError{Code: errInvalidValue, Field: "agent_name", message: fmt.Sprintf("Invalid agent name '%s'. Use letters, digits, spaces, '.', '-' and '_', starting and ending with a letter or digit", name)}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" .-_", r) {
+			return invalid
+		}
+	}
+	first, _ := utf8.DecodeRuneInString(name)
+	last, _ := utf8.DecodeLastRuneInString(name)
+	for _, r := range []rune{first, last} {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return invalid
+		}
+	}
+	if strings.EqualFold(name, serverSender) {
+		return &fieldError{Code: errInvalidValue, Field: "agent_name", message: fmt.Sprintf("Agent name '%s' is reserved", name)}
+	}
+	return nil
+}
+
+// agentToken returns how an agent is identified in subjects and consumer
+// names. Plain names are used as they are, so they stay readable in NATS
+// tooling; any other name maps to a hash of itself. Hashes start with '~',
+// which no name may contain, so the two can never collide.
+func agentToken(name string) string {
+	if plainName.MatchString(name) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "~" + hex.EncodeToString(sum[:12])
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultNeeds is how many open needs a needs request returns when it does
+// not ask for a number
+const defaultNeeds = 20
+
+// handleNeeds lists the needs that have no solution yet, those with the
+// nearest deadline first and the rest in the order they were sent. Needs
+// routed only to other agents are left out, as they never reach this one.
+func handleNeeds(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	limit := defaultNeeds
+	if n, ok := req["max"].(float64); ok {
+		if n < 1 {
+			_ = msg.Respond([]byte(`{"success": false, "message": "max must be a positive number"}`))
+			return
+		}
+		limit = int(n)
+	}
+
+	js, _ := nc.JetStream()
+
+	var needs []map[string]interface{}
+	solved := map[string]bool{}
+	err := scanStream(js, 1, func(m *nats.Msg) bool {
+		entry := mailboxEntry(m)
+		switch entry["type"] {
+		case "need":
+			if _, ok := routeFor(agentName, m); ok {
+				needs = append(needs, entry)
+			}
+		case "solution":
+			solved[entry["need_id"].(string)] = true
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Needs scan failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error listing needs"}`))
+		return
+	}
+
+	open := []map[string]interface{}{}
+	for _, entry := range needs {
+		if !solved[entry["id"].(string)] {
+			open = append(open, entry)
+		}
+	}
+	sort.SliceStable(open, func(i, j int) bool {
+		di, dj := open[i]["deadline"].(int64), open[j]["deadline"].(int64)
+		return di > 0 && (dj == 0 || di < dj)
+	})
+
+	// The most pressing needs come first, so later ones are cut down to
+	// stubs first, and left out once not even a stub fits in the reply
+	budget := int(nc.MaxPayload()) - replyOverhead
+	shown := 0
+	for shown < min(limit, len(open)) {
+		entry := open[shown]
+		entryData, _ := json.Marshal(entry)
+		if len(entryData)+1 > budget {
+			entry = stubEntry(entry)
+			entryData, _ = json.Marshal(entry)
+		}
+		if len(entryData)+1 > budget {
+			break
+		}
+		budget -= len(entryData) + 1
+		open[shown] = entry
+		shown++
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"needs":   open[:shown],
+		"more":    len(open) - shown,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	payloadBucket         = "PAYLOADS"
+	defaultInlinePayload  = 64 * 1024          // Payloads above this many bytes go to the object store
+	defaultMaxPayloadSize = 64 * 1024 * 1024   // Largest payload a message may carry
+	defaultPayloadStore   = 1024 * 1024 * 1024 // Most bytes the object store holds in all
+
+	// payloadMaxKey is the object store metadata that tells clients the
+	// payload limit, so they can check a payload before uploading it
+	payloadMaxKey = "needy.payload-max"
+
+	// encodingBase64 marks inline data that is binary and travels base64
+	// encoded. Payloads in the object store are always kept raw.
+	encodingBase64 = "base64"
+)
+
+// inlinePayload, maxPayloadSize and payloadStoreSize are the payload limits
+// in bytes (config: payload-inline-max, payload-max, payload-store-max)
+var (
+	inlinePayload    = defaultInlinePayload
+	maxPayloadSize   = defaultMaxPayloadSize
+	payloadStoreSize = defaultPayloadStore
+)
+
+// Attachment is a named file stored in the object store alongside a message
+type Attachment struct {
+	Name        string `json:"name"`
+	Ref         string `json:"ref"`
+	Size        uint64 `json:"size"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// errPayloadNotFound is returned for a payload reference with no stored object
+var errPayloadNotFound = errors.New("payload not found")
+
+// setupPayloadStore creates the object store bucket that holds large
+// payloads, or updates its size and payload limits if it exists. The store
+// never holds less than one payload of the largest size.
+func setupPayloadStore(js nats.JetStreamContext) error {
+	cfg := &nats.ObjectStoreConfig{
+		Bucket:      payloadBucket,
+		Description: "Message payloads too large to store inline",
+		Storage:     nats.FileStorage,
+		MaxBytes:    int64(max(payloadStoreSize, maxPayloadSize)),
+		Metadata:    map[string]string{payloadMaxKey: strconv.Itoa(maxPayloadSize)},
+	}
+	_, err := js.CreateObjectStore(cfg)
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		err = updatePayloadStore(js, cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create payload store: %w", err)
+	}
+	return nil
+}
+
+// updatePayloadStore applies the limits in cfg to the stream behind an
+// existing payload store
+func updatePayloadStore(js nats.JetStreamContext, cfg *nats.ObjectStoreConfig) error {
+	info, err := js.StreamInfo("OBJ_" + cfg.Bucket)
+	if err != nil {
+		return err
+	}
+	stream := info.Config
+	stream.MaxBytes = cfg.MaxBytes
+	if stream.Metadata == nil {
+		stream.Metadata = map[string]string{}
+	}
+	for k, v := range cfg.Metadata {
+		stream.Metadata[k] = v
+	}
+	_, err = js.UpdateStream(&stream)
+	return err
+}
+
+// storePayload moves data into the object store and returns its reference
+func storePayload(js nats.JetStreamContext, data []byte) (string, error) {
+	obs, err := js.ObjectStore(payloadBucket)
+	if err != nil {
+		return "", fmt.Errorf("failed to open payload store: %w", err)
+	}
+	name := uuid.New().String()
+	if _, err := obs.PutBytes(name, data); err != nil {
+		return "", fmt.Errorf("failed to store payload: %w", err)
+	}
+	return name, nil
+}
+
+// payloadSize returns the size of a payload a client uploaded itself
+func payloadSize(js nats.JetStreamContext, ref string) (uint64, error) {
+	obs, err := js.ObjectStore(payloadBucket)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open payload store: %w", err)
+	}
+	info, err := obs.GetInfo(ref)
+	if errors.Is(err, nats.ErrObjectNotFound) {
+		return 0, errPayloadNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to look up payload: %w", err)
+	}
+	return info.Size, nil
+}
+
+// discardPayload removes a stored payload that will not be referenced
+func discardPayload(js nats.JetStreamContext, ref string) {
+	if obs, err := js.ObjectStore(payloadBucket); err == nil {
+		_ = obs.Delete(ref)
+	}
+}
+
+// validContentType reports whether contentType is empty or a well-formed
+// media type
+func validContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	_, _, err := mime.ParseMediaType(contentType)
+	return err == nil
+}
+
+// isJSONType reports whether contentType is JSON, including +json suffixes
+func isJSONType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// preparePayload checks the content type and encoding of a send request,
+// moves its payload out of line when it is larger than inlineLimit, resolves
+// references to payloads and attachments the client uploaded itself, and
+// enforces the payload size limit across all of them. It returns a message
+// for the agent if the payload is refused. Only the copy made here is
+// discarded on refusal; references the client named may belong to other
+// messages.
+func preparePayload(js nats.JetStreamContext, req map[string]interface{}, m *Message, inlineLimit int) string {
+	var stored string
+	refuse := func(problem string) string {
+		if stored != "" {
+			discardPayload(js, stored)
+		}
+		return problem
+	}
+	lookup := func(ref string) (uint64, string) {
+		size, err := payloadSize(js, ref)
+		if errors.Is(err, errPayloadNotFound) {
+			return 0, "Payload not found. Upload it to the PAYLOADS object store before sending"
+		} else if err != nil {
+			log.Printf("Payload lookup failed: %v", err)
+			return 0, "Internal error storing payload"
+		}
+		return size, ""
+	}
+
+	m.ContentType, _ = req["content_type"].(string)
+	m.Encoding, _ = req["encoding"].(string)
+	if !validContentType(m.ContentType) {
+		return refuse(fmt.Sprintf("Invalid content type %q", m.ContentType))
+	}
+	if m.Encoding != "" && m.Encoding != encodingBase64 {
+		return refuse(fmt.Sprintf("Unsupported encoding %q (only base64 is supported)", m.Encoding))
+	}
+
+	var total uint64
+	if ref, _ := req["data_ref"].(string); ref != "" {
+		size, problem := lookup(ref)
+		if problem != "" {
+			return refuse(problem)
+		}
+		m.Data, m.Encoding, m.DataRef, m.DataSize = "", "", ref, size
+		total += size
+	} else {
+		raw := []byte(m.Data)
+		if m.Encoding == encodingBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(m.Data)
+			if err != nil {
+				return refuse("Payload is not valid base64")
+			}
+			raw = decoded
+		}
+		if len(raw) > 0 && isJSONType(m.ContentType) && !json.Valid(raw) {
+			return refuse(fmt.Sprintf("Payload is not valid JSON although its content type is %s", m.ContentType))
+		}
+
+		size := uint64(len(raw))
+		if len(m.Data) > inlineLimit {
+			if size > uint64(maxPayloadSize) {
+				return refuse(fmt.Sprintf("Payload too large (%d bytes, max %d bytes)", size, maxPayloadSize))
+			}
+			ref, err := storePayload(js, raw)
+			if err != nil {
+				log.Printf("Payload store failed: %v", err)
+				return refuse("Internal error storing payload")
+			}
+			stored = ref
+			m.Data, m.Encoding, m.DataRef, m.DataSize = "", "", ref, size
+		}
+		total += size
+	}
+
+	// Attachments are saved under their names, so no two may share one
+	names := map[string]bool{}
+	rawAttachments, _ := req["attachments"].([]interface{})
+	for _, raw := range rawAttachments {
+		fields, _ := raw.(map[string]interface{})
+		name, _ := fields["name"].(string)
+		ref, _ := fields["ref"].(string)
+		contentType, _ := fields["content_type"].(string)
+		name = filepath.Base(name)
+		if ref == "" || name == "." || name == ".." || name == "/" {
+			return refuse("Each attachment needs a file name and a ref")
+		}
+		if names[name] {
+			return refuse(fmt.Sprintf("More than one attachment is named %s. Rename one of them before sending", name))
+		}
+		names[name] = true
+		if !validContentType(contentType) {
+			return refuse(fmt.Sprintf("Invalid content type %q for attachment %s", contentType, name))
+		}
+		size, problem := lookup(ref)
+		if problem != "" {
+			return refuse(problem)
+		}
+		m.Attachments = append(m.Attachments, Attachment{Name: name, Ref: ref, Size: size, ContentType: contentType})
+		total += size
+	}
+
+	if total > uint64(maxPayloadSize) {
+		return refuse(fmt.Sprintf("Payload too large (%d bytes, max %d bytes)", total, maxPayloadSize))
+	}
+	return ""
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Presence of an agent, judged by when it last talked to the server
+const (
+	statusOnline  = "online"
+	statusIdle    = "idle"
+	statusOffline = "offline"
+)
+
+const (
+	defaultPresenceOnline = 120 // Seconds an agent counts as online after it was last seen
+	defaultPresenceIdle   = 900 // Seconds after which it counts as offline
+)
+
+// Presence windows in seconds (config: presence-online, presence-idle)
+var (
+	presenceOnline = defaultPresenceOnline
+	presenceIdle   = defaultPresenceIdle
+)
+
+// presence returns the status of an agent last seen at the given Unix time
+func presence(lastSeen int64, now time.Time) string {
+	since := now.Sub(time.Unix(lastSeen, 0))
+	switch {
+	case since < time.Duration(presenceOnline)*time.Second:
+		return statusOnline
+	case since < time.Duration(presenceIdle)*time.Second:
+		return statusIdle
+	default:
+		return statusOffline
+	}
+}
+
+// othersOnline counts the agents other than agentName that are online
+func othersOnline(agentName string, now time.Time) int {
+	online := 0
+	for _, agent := range registry.Agents() {
+		if agent.Name != agentName && presence(agent.LastSeen, now) == statusOnline {
+			online++
+		}
+	}
+	return online
+}
+
+// handleHeartbeat records that an agent is alive. Every request does so;
+// heartbeats keep agents that are busy elsewhere from turning idle.
+func handleHeartbeat(msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	now := time.Now()
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, now)
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success":   true,
+		"message":   fmt.Sprintf("%s is online", agentName),
+		"last_seen": now.Unix(),
+		"online":    othersOnline(agentName, now),
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Priorities a need may be sent with. Needs sent without one are normal.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+// defaultHighPriorityPerHour is how many high-priority needs one agent may
+// send in any hour
+const defaultHighPriorityPerHour = 10
+
+// highPriorityPerHour caps high-priority needs per agent and hour; zero
+// lifts the cap (config: high-priority-per-hour)
+var highPriorityPerHour = defaultHighPriorityPerHour
+
+// priorityLookahead is how many messages past the batch a read looks at for
+// more urgent needs. Every message looked at but not read is handed back and
+// counts as redelivered, so the window is kept small.
+const priorityLookahead = 10
+
+// priorityRank orders priorities, higher first
+func priorityRank(priority string) int {
+	switch priority {
+	case priorityHigh:
+		return 2
+	case priorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// validatePriority checks the priority field of a send request
+func validatePriority(req map[string]interface{}, msgType string) *fieldError {
+	priority, fe := stringField(req, "priority")
+	if fe != nil || priority == "" {
+		return fe
+	}
+	known := false
+	for _, p := range priorities {
+		known = known || p == priority
+	}
+	if !known {
+		return &fieldError{Code: errInvalidValue, Field: "priority", message: fmt.Sprintf("Unknown priority '%s' (use %s)", priority, strings.Join(priorities, ", "))}
+	}
+	if msgType != "need" {
+		return &fieldError{Code: errInvalidValue, Field: "priority", message: "Only needs have a priority"}
+	}
+	return nil
+}
+
+// prioritize orders mailbox messages so that higher-priority threads come
+// first. A message belongs to the thread of the need it refers to and takes
+// that need's priority, so the sort being stable keeps every thread in the
+// order it was sent.
+func prioritize(js nats.JetStreamContext, msgs []*nats.Msg) []*nats.Msg {
+	ranks := make([]int, len(msgs))
+	needRanks := map[string]int{}
+	for i, m := range msgs {
+		var payload Message
+		_ = json.Unmarshal(m.Data, &payload)
+		if payload.Type == "need" {
+			ranks[i] = priorityRank(payload.Priority)
+			if meta, err := m.Metadata(); err == nil {
+				needRanks[strconv.FormatUint(meta.Sequence.Stream, 10)] = ranks[i]
+			}
+			continue
+		}
+		ranks[i] = threadRank(js, payload.NeedID, needRanks)
+	}
+
+	order := make([]int, len(msgs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return ranks[order[a]] > ranks[order[b]] })
+
+	sorted := make([]*nats.Msg, len(msgs))
+	for i, j := range order {
+		sorted[i] = msgs[j]
+	}
+	return sorted
+}
+
+// threadRank returns the priority rank of the need with the given ID,
+// looking it up in the stream when it is not among the known ranks
+func threadRank(js nats.JetStreamContext, needID string, known map[string]int) int {
+	if needID == "" {
+		return priorityRank(priorityNormal)
+	}
+	if rank, ok := known[needID]; ok {
+		return rank
+	}
+	rank := priorityRank(priorityNormal)
+	if seq, err := strconv.ParseUint(needID, 10, 64); err == nil {
+		if stored, err := js.GetMsg(messageStream, seq); err == nil {
+			var need Message
+			if json.Unmarshal(stored.Data, &need) == nil && need.Type == "need" {
+				rank = priorityRank(need.Priority)
+			}
+		}
+	}
+	known[needID] = rank
+	return rank
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	descriptionMax  = 200 // Longest profile description
+	profileFieldMax = 100 // Longest model or repository
+	skillsMax       = 20  // Most skills one agent may advertise
+	skillMax        = 32  // Longest skill tag
+)
+
+// skillTag matches a normalised skill: lower case, with the punctuation
+// found in names like c++, c# and node.js
+var skillTag = regexp.MustCompile(`^[\p{Ll}\p{N}][\p{Ll}\p{N}.+#_-]*$`)
+
+// Profile tells other agents who an agent is and what it is good at
+type Profile struct {
+	Description string   `json:"description,omitempty"`
+	Model       string   `json:"model,omitempty"` // Model or tool the agent runs on
+	Skills      []string `json:"skills,omitempty"`
+	Repo        string   `json:"repo,omitempty"` // Repository the agent works in
+}
+
+// ProfileUpdate changes the fields of a profile that are present and
+// leaves the others alone. Skills, when present, replace the old list.
+type ProfileUpdate struct {
+	Description *string   `json:"description,omitempty"`
+	Model       *string   `json:"model,omitempty"`
+	Skills      *[]string `json:"skills,omitempty"`
+	Repo        *string   `json:"repo,omitempty"`
+}
+
+// AgentEntry is one agent in the directory
+type AgentEntry struct {
+	Name string `json:"name"`
+	Profile
+	Status   string `json:"status,omitempty"`    // online, idle or offline
+	LastSeen int64  `json:"last_seen,omitempty"` // Unix time the agent last talked to the server
+}
+
+// normalizeSkill trims and lower-cases a skill tag
+func normalizeSkill(skill string) string {
+	return strings.ToLower(strings.TrimSpace(skill))
+}
+
+// validate checks the fields present in an update and normalises its skills
+func (u *ProfileUpdate) validate() *fieldError {
+	for _, check := range []struct {
+		field string
+		value *string
+		limit int
+	}{
+		{"description", u.Description, descriptionMax},
+		{"model", u.Model, profileFieldMax},
+		{"repo", u.Repo, profileFieldMax},
+	} {
+		if check.value != nil && len(*check.value) > check.limit {
+			return &fieldError{Code: errTooLong, Field: "profile." + check.field, Limit: check.limit, message: fmt.Sprintf("Profile %s too long (max %d chars)", check.field, check.limit)}
+		}
+	}
+
+	if u.Skills == nil {
+		return nil
+	}
+	skills, fe := normalizeSkills(*u.Skills, "profile.skills")
+	if fe != nil {
+		return fe
+	}
+	*u.Skills = skills
+	return nil
+}
+
+// normalizeSkills checks and normalises a list of skills, dropping duplicates
+func normalizeSkills(raw []string, field string) ([]string, *fieldError) {
+	if len(raw) > skillsMax {
+		return nil, &fieldError{Code: errTooMany, Field: field, Limit: skillsMax, message: fmt.Sprintf("Too many skills (max %d)", skillsMax)}
+	}
+	var skills []string
+	seen := map[string]bool{}
+	for _, skill := range raw {
+		skill = normalizeSkill(skill)
+		if len(skill) > skillMax {
+			return nil, &fieldError{Code: errTooLong, Field: field, Limit: skillMax, message: fmt.Sprintf("Skill '%s' too long (max %d chars)", skill, skillMax)}
+		}
+		if !skillTag.MatchString(skill) {
+			return nil, &fieldError{Code: errInvalidValue, Field: field, message: fmt.Sprintf("Invalid skill '%s'. Use one word of letters, digits and . + # - _, e.g. go, c++, node.js", skill)}
+		}
+		if !seen[skill] {
+			seen[skill] = true
+			skills = append(skills, skill)
+		}
+	}
+	return skills, nil
+}
+
+// skillsField returns the normalised skills listed in a request field
+func skillsField(req map[string]interface{}, field string) ([]string, *fieldError) {
+	raw, ok := req[field]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, &fieldError{Code: errInvalidType, Field: field, message: fmt.Sprintf("Field %s must be a list of strings", field)}
+	}
+	skills := make([]string, 0, len(list))
+	for _, item := range list {
+		skill, ok := item.(string)
+		if !ok {
+			return nil, &fieldError{Code: errInvalidType, Field: field, message: fmt.Sprintf("Field %s must be a list of strings", field)}
+		}
+		skills = append(skills, skill)
+	}
+	return normalizeSkills(skills, field)
+}
+
+// apply changes p by the fields present in the update
+func (u *ProfileUpdate) apply(p *Profile) {
+	if u.Description != nil {
+		p.Description = *u.Description
+	}
+	if u.Model != nil {
+		p.Model = *u.Model
+	}
+	if u.Skills != nil {
+		p.Skills = *u.Skills
+	}
+	if u.Repo != nil {
+		p.Repo = *u.Repo
+	}
+}
+
+// handleProfile updates the profile of the agent making the request
+func handleProfile(msg *nats.Msg) {
+	var req struct {
+		ClientID string        `json:"client_id"`
+		Profile  ProfileUpdate `json:"profile"`
+	}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	agentName := registry.CheckIn(req.ClientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	if fe := req.Profile.validate(); fe != nil {
+		respondFieldError(msg, fe)
+		return
+	}
+	profile := registry.UpdateProfile(agentName, req.Profile)
+
+	resp := map[string]interface{}{
+		"success": true,
+		"message": "Profile updated",
+		"agent":   AgentEntry{Name: agentName, Profile: profile},
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+	fmt.Printf("ndadm: Agent '%s' updated their profile\n", agentName)
+}
+
+// handleAgents lists the registered agents with their profiles and
+// presence, optionally only those advertising a skill
+func handleAgents(msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	if registry.CheckIn(clientID, time.Now()) == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+	skill, _ := req["skill"].(string)
+
+	now := time.Now()
+	agents := []AgentEntry{}
+	for _, entry := range registry.Agents() {
+		if skill == "" || hasSkill(entry.Skills, normalizeSkill(skill)) {
+			entry.Status = presence(entry.LastSeen, now)
+			agents = append(agents, entry)
+		}
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"agents":  agents,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
+
+// hasSkill reports whether skills contains skill
+func hasSkill(skills []string, skill string) bool {
+	for _, s := range skills {
+		if s == skill {
+			return true
+		}
+	}
+	return false
+}
@@ -2,14 +2,43 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Registry manages the state of agents and their intents
 type Registry struct {
 	mu           sync.RWMutex
-	agents       map[string]string          // AgentName -> ClientID
-	agentIntents map[string]map[string]bool // AgentName -> NeedID -> bool
+	agents       map[string]string              // AgentName -> ClientID
+	agentIntents map[string]map[string]bool     // AgentName -> NeedID -> bool
+	profiles     map[string]Profile             // AgentName -> Profile
+	highSent     map[string][]time.Time         // AgentName -> when its recent high-priority needs were sent
+	readAhead    map[string]map[uint64]bool     // AgentName -> mailbox messages read before earlier ones
+	deadlines    map[string]*openDeadline       // NeedID -> deadline of an open need
+	lastSeen     map[string]time.Time           // AgentName -> when it last talked to the server
+	claims       map[string]map[string][]string // AgentName -> NeedID -> path globs its open intent claims
+	mailboxes    map[string]*sync.RWMutex       // AgentName -> lock guarding its mailbox consumer
+	generations  map[string]uint64              // AgentName -> how often its mailbox consumer was replaced or refiltered
+	routes       map[uint64]map[string]bool     // Stream sequence of a routed need -> agents it reaches
+}
+
+// openDeadline is the deadline of a need that has no solution yet
+type openDeadline struct {
+	owner    string
+	text     string
+	due      time.Time
+	lead     time.Duration   // How long before due the agents working on it are reminded
+	reminded map[string]bool // Agents already reminded
+}
+
+// DeadlineEvent is a reminder or overdue notice that has fallen due
+type DeadlineEvent struct {
+	Type   string // "reminder" or "overdue"
+	NeedID string
+	Agent  string // Who it is for
+	Text   string // Text of the need
+	Due    time.Time
 }
 
 // NewRegistry creates a new initialized registry
@@ -17,6 +46,15 @@ func NewRegistry() *Registry {
 	return &Registry{
 		agents:       make(map[string]string),
 		agentIntents: make(map[string]map[string]bool),
+		profiles:     make(map[string]Profile),
+		highSent:     make(map[string][]time.Time),
+		readAhead:    make(map[string]map[uint64]bool),
+		deadlines:    make(map[string]*openDeadline),
+		lastSeen:     make(map[string]time.Time),
+		claims:       make(map[string]map[string][]string),
+		mailboxes:    make(map[string]*sync.RWMutex),
+		generations:  make(map[string]uint64),
+		routes:       make(map[uint64]map[string]bool),
 	}
 }
 
@@ -34,22 +72,34 @@ func (r *Registry) RegisterAgent(name, clientID string) (bool, string, bool) {
 	}
 
 	r.agents[name] = clientID
+	r.lastSeen[name] = time.Now()
 	return true, fmt.Sprintf("Registered %s successfully", name), false
 }
 
-// GetAgentName returns the agent name for a given client ID, or empty string if not found
-func (r *Registry) GetAgentName(clientID string) string {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// CheckIn returns the agent name for a given client ID, or empty string if
+// not found, and records that the agent was seen at now
+func (r *Registry) CheckIn(clientID string, now time.Time) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
 	for name, id := range r.agents {
 		if id == clientID {
+			r.lastSeen[name] = now
 			return name
 		}
 	}
 	return ""
 }
 
+// IsRegistered reports whether an agent with the given name is registered
+func (r *Registry) IsRegistered(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, exists := r.agents[name]
+	return exists
+}
+
 // RecordIntent records that an agent intends to solve a need
 func (r *Registry) RecordIntent(agent, needID string) {
 	r.mu.Lock()
@@ -61,6 +111,57 @@ func (r *Registry) RecordIntent(agent, needID string) {
 	r.agentIntents[agent][needID] = true
 }
 
+// WithdrawIntent records that an agent no longer intends to solve a need
+func (r *Registry) WithdrawIntent(agent, needID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.agentIntents[agent], needID)
+	delete(r.claims[agent], needID)
+}
+
+// ClaimPaths records the path globs an agent's intent on a need claims,
+// replacing any it claimed before, and returns the open intents of other
+// agents that claim overlapping ones
+func (r *Registry) ClaimPaths(agent, needID string, paths []string) []PathConflict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var conflicts []PathConflict
+	for other, intents := range r.claims {
+		if other == agent {
+			continue
+		}
+		for otherNeed, theirs := range intents {
+			if hits := overlapping(paths, theirs); len(hits) > 0 {
+				conflicts = append(conflicts, PathConflict{Agent: other, NeedID: otherNeed, Paths: hits})
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Agent != conflicts[j].Agent {
+			return conflicts[i].Agent < conflicts[j].Agent
+		}
+		return conflicts[i].NeedID < conflicts[j].NeedID
+	})
+
+	if _, ok := r.claims[agent]; !ok {
+		r.claims[agent] = make(map[string][]string)
+	}
+	r.claims[agent][needID] = paths
+	return conflicts
+}
+
+// ReleaseClaims forgets the paths every agent claimed for a solved need
+func (r *Registry) ReleaseClaims(needID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, intents := range r.claims {
+		delete(intents, needID)
+	}
+}
+
 // HasIntent checks if an agent has declared intent for a need
 func (r *Registry) HasIntent(agent, needID string) bool {
 	r.mu.RLock()
@@ -71,3 +172,229 @@ func (r *Registry) HasIntent(agent, needID string) bool {
 	}
 	return false
 }
+
+// UpdateProfile applies an update to an agent's profile and returns the result
+func (r *Registry) UpdateProfile(agent string, update ProfileUpdate) Profile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	profile := r.profiles[agent]
+	update.apply(&profile)
+	r.profiles[agent] = profile
+	return profile
+}
+
+// Agents returns every registered agent with its profile, sorted by name
+func (r *Registry) Agents() []AgentEntry {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	agents := make([]AgentEntry, 0, len(r.agents))
+	for name := range r.agents {
+		agents = append(agents, AgentEntry{Name: name, Profile: r.profiles[name], LastSeen: r.lastSeen[name].Unix()})
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// HighPriorityWait returns how long the agent has to wait before its hourly
+// allowance of high-priority needs lets it send another, or zero if it
+// may send one now
+func (r *Registry) HighPriorityWait(agent string, limit int, now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if limit <= 0 {
+		return 0
+	}
+	sent := r.highSent[agent]
+	for len(sent) > 0 && now.Sub(sent[0]) >= time.Hour {
+		sent = sent[1:]
+	}
+	r.highSent[agent] = sent
+	if len(sent) >= limit {
+		return sent[len(sent)-limit].Add(time.Hour).Sub(now)
+	}
+	return 0
+}
+
+// TakeHighPriority counts a high-priority need the agent has sent against
+// its hourly allowance
+func (r *Registry) TakeHighPriority(agent string, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.highSent[agent] = append(r.highSent[agent], now)
+}
+
+// mailboxLock returns the lock guarding an agent's mailbox consumer
+func (r *Registry) mailboxLock(agent string) *sync.RWMutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lock, ok := r.mailboxes[agent]
+	if !ok {
+		lock = &sync.RWMutex{}
+		r.mailboxes[agent] = lock
+	}
+	return lock
+}
+
+// LockMailbox takes an agent's mailbox for a rewind or filter change, which
+// replace its consumer, and returns the function that releases it. It waits
+// for reads in progress and holds off new ones until released.
+func (r *Registry) LockMailbox(agent string) func() {
+	lock := r.mailboxLock(agent)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// ShareMailbox takes an agent's mailbox for reading, which any number of
+// reads and watches may do at once, and returns the function that releases it
+func (r *Registry) ShareMailbox(agent string) func() {
+	lock := r.mailboxLock(agent)
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// ChangeMailbox records that an agent's mailbox consumer was replaced or
+// given new filters, so watches bound to it bind again
+func (r *Registry) ChangeMailbox(agent string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.generations[agent]++
+}
+
+// MailboxGeneration returns how often an agent's mailbox consumer has been
+// replaced or refiltered
+func (r *Registry) MailboxGeneration(agent string) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.generations[agent]
+}
+
+// MarkReadAhead records mailbox messages an agent read while earlier ones
+// were left for later
+func (r *Registry) MarkReadAhead(agent string, seqs []uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.readAhead[agent]; !ok {
+		r.readAhead[agent] = make(map[uint64]bool)
+	}
+	for _, seq := range seqs {
+		r.readAhead[agent][seq] = true
+	}
+}
+
+// ForgetReadAhead drops the messages an agent read ahead, as when its
+// mailbox is recreated and delivers them again
+func (r *Registry) ForgetReadAhead(agent string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.readAhead, agent)
+}
+
+// ReadAhead returns the messages an agent read ahead of its ack floor,
+// forgetting those the floor has caught up with
+func (r *Registry) ReadAhead(agent string, floor uint64) map[uint64]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	read := make(map[uint64]bool)
+	for seq := range r.readAhead[agent] {
+		if seq <= floor {
+			delete(r.readAhead[agent], seq)
+			continue
+		}
+		read[seq] = true
+	}
+	return read
+}
+
+// RecordRoute remembers who a need routed by skill reaches: its sender and
+// the agents it was routed to
+func (r *Registry) RecordRoute(seq uint64, sender string, routedTo map[string][]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reached := map[string]bool{sender: true}
+	for agent := range routedTo {
+		reached[agent] = true
+	}
+	r.routes[seq] = reached
+}
+
+// RoutedAway counts the routed needs stored after the given sequence that
+// do not reach the agent
+func (r *Registry) RoutedAway(agent string, after uint64) uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count uint64
+	for seq, reached := range r.routes {
+		if seq > after && !reached[agent] {
+			count++
+		}
+	}
+	return count
+}
+
+// TrackDeadline watches the deadline of a need until it is solved
+func (r *Registry) TrackDeadline(needID, owner, text string, due time.Time, lead time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deadlines[needID] = &openDeadline{owner: owner, text: text, due: due, lead: lead, reminded: make(map[string]bool)}
+}
+
+// MarkReminded records that an agent was already reminded of a need's
+// deadline, so it is not reminded again
+func (r *Registry) MarkReminded(needID, agent string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if d, ok := r.deadlines[needID]; ok {
+		d.reminded[agent] = true
+	}
+}
+
+// SettleDeadline stops watching the deadline of a solved need
+func (r *Registry) SettleDeadline(needID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.deadlines, needID)
+}
+
+// DueDeadlines returns the events that have fallen due by now: a reminder
+// for every agent with intent on a need whose deadline is near that was not
+// reminded yet, and an overdue notice for the owner of every need whose
+// deadline has passed. Overdue needs are no longer watched.
+func (r *Registry) DueDeadlines(now time.Time) []DeadlineEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var events []DeadlineEvent
+	for needID, d := range r.deadlines {
+		if !now.Before(d.due) {
+			events = append(events, DeadlineEvent{Type: "overdue", NeedID: needID, Agent: d.owner, Text: d.text, Due: d.due})
+			delete(r.deadlines, needID)
+			continue
+		}
+		if d.due.Sub(now) > d.lead {
+			continue
+		}
+		for agent, intents := range r.agentIntents {
+			if intents[needID] && !d.reminded[agent] {
+				d.reminded[agent] = true
+				events = append(events, DeadlineEvent{Type: "reminder", NeedID: needID, Agent: agent, Text: d.text, Due: d.due})
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Due.Before(events[j].Due) })
+	return events
+}
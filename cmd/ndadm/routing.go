@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+)
+
+// routeNeed decides who a need asking for skills is delivered to: every
+// other agent whose profile advertises at least one of them, each with the
+// skills it matched. When nobody matches the need is broadcast, which is
+// reported as no routes.
+func routeNeed(sender string, skills []string) map[string][]string {
+	if len(skills) == 0 {
+		return nil
+	}
+	routes := map[string][]string{}
+	for _, agent := range registry.Agents() {
+		if agent.Name == sender {
+			continue
+		}
+		for _, skill := range skills {
+			if hasSkill(agent.Skills, skill) {
+				routes[agent.Name] = append(routes[agent.Name], skill)
+			}
+		}
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+	return routes
+}
+
+// routedAgents returns the names of the agents a need was routed to, sorted
+func routedAgents(routes map[string][]string) []string {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// restoreRoutes records who the routed needs already in the stream reach,
+// as sending them did before a restart
+func restoreRoutes(js nats.JetStreamContext) error {
+	return scanSubjects(js, 1, []string{messageSubj, messageSubj + ".need.>"}, func(m *nats.Msg) bool {
+		var payload Message
+		meta, err := m.Metadata()
+		if err != nil || json.Unmarshal(m.Data, &payload) != nil {
+			return true
+		}
+		if payload.Type == "need" && len(payload.RoutedTo) > 0 {
+			registry.RecordRoute(meta.Sequence.Stream, payload.Sender, payload.RoutedTo)
+		}
+		return true
+	})
+}
+
+// routeFor reports whether a stored message is delivered to an agent and,
+// for a need routed to it, which of its skills got it there. Routed needs
+// still reach their sender.
+func routeFor(agentName string, m *nats.Msg) ([]string, bool) {
+	var payload Message
+	if err := json.Unmarshal(m.Data, &payload); err != nil {
+		return nil, true
+	}
+	if payload.Type != "need" || len(payload.RoutedTo) == 0 || payload.Sender == agentName {
+		return nil, true
+	}
+	skills, ok := payload.RoutedTo[agentName]
+	return skills, ok
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// handleSettle marks the given messages of an agent's mailbox as read and
+// leaves every other message unread. nd serve peeks at its mailbox and only
+// settles the needs it claims, so what it passes over still reaches
+// nd receive.
+func handleSettle(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	seqs := map[uint64]bool{}
+	rawIDs, _ := req["ids"].([]interface{})
+	for _, raw := range rawIDs {
+		id, _ := raw.(string)
+		var seq uint64
+		if _, err := fmt.Sscanf(id, "%d", &seq); err != nil || seq == 0 {
+			_ = msg.Respond(failureReply(fmt.Sprintf("Invalid message ID '%s'", id)))
+			return
+		}
+		seqs[seq] = true
+	}
+	if len(seqs) == 0 {
+		_ = msg.Respond([]byte(`{"success": false, "message": "ids must name the messages to settle"}`))
+		return
+	}
+
+	js, _ := nc.JetStream()
+
+	unlock := registry.ShareMailbox(agentName)
+	settled, err := settleMessages(js, agentName, seqs)
+	unlock()
+	if err != nil {
+		log.Printf("Mailbox settle failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Mailbox error"}`))
+		return
+	}
+
+	resp := map[string]interface{}{
+		"success": true,
+		"settled": settled,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
+
+// settleMessages reads the agent's mailbox up to the highest of seqs,
+// acknowledging the messages in seqs and handing every other one back, and
+// returns how many it acknowledged. Messages already read, or held by
+// another read, are not found and so not counted.
+func settleMessages(js nats.JetStreamContext, agentName string, seqs map[uint64]bool) (int, error) {
+	var highest uint64
+	for seq := range seqs {
+		highest = max(highest, seq)
+	}
+
+	sub, err := openMailbox(js, agentName)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = sub.Unsubscribe() }()
+
+	// Nothing is handed back until the end, or the mailbox would deliver
+	// the same messages again before reaching the ones to settle
+	var read, putBack []*nats.Msg
+	defer func() { settleMailbox(agentName, read, putBack) }()
+	for {
+		msgs, err := fetchMailbox(sub, defaultFetch, 100*time.Millisecond)
+		if err != nil {
+			return 0, err
+		}
+		if len(msgs) == 0 {
+			return len(read), nil
+		}
+		reached := false
+		for _, m := range msgs {
+			meta, err := m.Metadata()
+			if err == nil && seqs[meta.Sequence.Stream] {
+				read = append(read, m)
+			} else {
+				putBack = append(putBack, m)
+			}
+			reached = reached || err == nil && meta.Sequence.Stream >= highest
+		}
+		if reached {
+			return len(read), nil
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// scanBatch is how many stored messages a stream scan fetches at a time
+const scanBatch = 100
+
+// openReader opens a short-lived, unacknowledged reader on the message stream
+// starting at startSeq and limited to the given filter subjects. The returned
+// close function removes the reader again.
+func openReader(js nats.JetStreamContext, startSeq uint64, filter string, filters []string) (*nats.Subscription, func(), error) {
+	if startSeq == 0 {
+		startSeq = 1
+	}
+	reader, err := js.AddConsumer(messageStream, &nats.ConsumerConfig{
+		AckPolicy:         nats.AckNonePolicy,
+		DeliverPolicy:     nats.DeliverByStartSequencePolicy,
+		OptStartSeq:       startSeq,
+		FilterSubject:     filter,
+		FilterSubjects:    filters,
+		InactiveThreshold: time.Minute,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open stream reader: %w", err)
+	}
+	closeReader := func() { _ = js.DeleteConsumer(messageStream, reader.Name) }
+
+	sub, err := js.PullSubscribe(reader.Config.FilterSubject, "", nats.Bind(messageStream, reader.Name))
+	if err != nil {
+		closeReader()
+		return nil, nil, fmt.Errorf("failed to open stream reader: %w", err)
+	}
+	return sub, func() {
+		_ = sub.Unsubscribe()
+		closeReader()
+	}, nil
+}
+
+// scanStream calls fn for every stored message from startSeq onwards, in
+// stream order, stopping early if fn returns false
+func scanStream(js nats.JetStreamContext, startSeq uint64, fn func(m *nats.Msg) bool) error {
+	return scanSubjects(js, startSeq, nil, fn)
+}
+
+// scanSubjects is scanStream limited to messages matching one of filters,
+// or to none of them when filters is empty
+func scanSubjects(js nats.JetStreamContext, startSeq uint64, filters []string, fn func(m *nats.Msg) bool) error {
+	sub, closeReader, err := openReader(js, startSeq, "", filters)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	for {
+		info, err := sub.ConsumerInfo()
+		if err != nil {
+			return fmt.Errorf("failed to scan stream: %w", err)
+		}
+		if info.NumPending == 0 {
+			return nil
+		}
+		msgs, err := fetchMailbox(sub, scanBatch, time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to scan stream: %w", err)
+		}
+		if len(msgs) == 0 {
+			return nil
+		}
+		for _, m := range msgs {
+			if !fn(m) {
+				return nil
+			}
+		}
+	}
+}
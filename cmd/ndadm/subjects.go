@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// allMessagesSubj matches every message published to the network since
+// messages have per-type subjects. Older messages stay on messageSubj itself.
+const allMessagesSubj = messageSubj + ".>"
+
+// messageTypes lists the message types agents can filter on. Reminders,
+// overdue notices and conflicts are only ever sent by the server.
+var messageTypes = []string{"need", "intent", "withdraw", "solution", "question", "answer", "progress", "cancel", "dm", "reminder", "overdue", "conflict"}
+
+// serverSender is the sender of the messages the server publishes on its own
+const serverSender = "ndadm"
+
+// isMessageType reports whether t is one of the known message types
+func isMessageType(t string) bool {
+	for _, known := range messageTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isReplyType reports whether messages of type t refer to a need
+func isReplyType(t string) bool {
+	switch t {
+	case "intent", "withdraw", "solution", "question", "answer", "progress", "cancel":
+		return true
+	}
+	return false
+}
+
+// isAddressedType reports whether messages of type t are addressed to a
+// single agent
+func isAddressedType(t string) bool {
+	switch t {
+	case "dm", "reminder", "overdue", "conflict":
+		return true
+	}
+	return false
+}
+
+// subjectToken makes s safe to use as a single subject token by replacing
+// separators, wildcards and whitespace
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// messageSubject returns the subject a message is published to:
+// needy.messages.<type>.<sender>, followed by the owner of the need for
+// replies or by the recipient for direct messages. Agents appear by their
+// agentToken.
+func messageSubject(msgType, sender, target string) string {
+	subj := fmt.Sprintf("%s.%s.%s", messageSubj, subjectToken(msgType), agentToken(sender))
+	if target != "" {
+		subj += "." + agentToken(target)
+	}
+	return subj
+}
+
+// mailboxFilters returns the filter subjects for an agent's mailbox. types
+// limits delivery to those message types (all when empty); mine limits
+// replies to the ones about the agent's own needs. Needs, and answers and
+// cancels, which only ever come from a need's owner, are never limited by
+// mine. Only direct messages, reminders, overdue notices and conflicts
+// addressed to the agent are ever delivered. An unlimited mailbox also gets the messages published
+// before messages had per-type subjects, which carry no type to filter on.
+func mailboxFilters(agentName string, types []string, mine bool) []string {
+	var filters []string
+	if len(types) == 0 {
+		types = messageTypes
+		if !mine {
+			filters = append(filters, messageSubj)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, t := range types {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		switch {
+		case isAddressedType(t):
+			filters = append(filters, fmt.Sprintf("%s.%s.*.%s", messageSubj, t, agentToken(agentName)))
+		case mine && t != "need" && t != "answer" && t != "cancel":
+			filters = append(filters, fmt.Sprintf("%s.%s.*.%s", messageSubj, t, agentToken(agentName)))
+		default:
+			filters = append(filters, fmt.Sprintf("%s.%s.>", messageSubj, t))
+		}
+	}
+	return filters
+}
+
+// needOwner returns the name of the agent that sent the need with the given
+// ID, or an empty string if it is not a stored need
+func needOwner(js nats.JetStreamContext, needID string) string {
+	var seq uint64
+	if _, err := fmt.Sscanf(needID, "%d", &seq); err != nil || seq == 0 {
+		return ""
+	}
+	m, err := js.GetMsg(messageStream, seq)
+	if err != nil {
+		return ""
+	}
+	var payload Message
+	if err := json.Unmarshal(m.Data, &payload); err != nil || payload.Type != "need" {
+		return ""
+	}
+	return payload.Sender
+}
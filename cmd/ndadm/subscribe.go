@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// handleSubscribe stores an agent's delivery preferences as filter subjects
+// on its mailbox consumer. An empty request restores delivery of everything.
+func handleSubscribe(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	var types []string
+	rawTypes, _ := req["types"].([]interface{})
+	for _, raw := range rawTypes {
+		t, _ := raw.(string)
+		if !isMessageType(t) {
+			resp := map[string]interface{}{
+				"success": false,
+				"message": fmt.Sprintf("Unknown message type '%s' (use %s)", t, strings.Join(messageTypes, ", ")),
+			}
+			respData, _ := json.Marshal(resp)
+			_ = msg.Respond(respData)
+			return
+		}
+		types = append(types, t)
+	}
+	mine, _ := req["mine"].(bool)
+
+	js, _ := nc.JetStream()
+
+	unlock := registry.LockMailbox(agentName)
+	defer unlock()
+	info, err := ensureMailbox(js, agentName)
+	if err == nil {
+		info, err = filterMailbox(js, info, agentName, types, mine)
+	}
+	if err != nil {
+		log.Printf("Subscribe failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Mailbox error"}`))
+		return
+	}
+
+	text := "Subscribed to all messages"
+	if len(types) > 0 {
+		text = fmt.Sprintf("Subscribed to %s messages", strings.Join(types, ", "))
+	}
+	if mine {
+		text += " (replies only to your own needs)"
+	}
+	resp := map[string]interface{}{
+		"success": true,
+		"message": text,
+		"filters": info.Config.FilterSubjects,
+		"pending": mailboxPending(js, agentName),
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+	fmt.Printf("ndadm: Agent '%s' changed their subscription\n", agentName)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// defaultThread is how many replies a thread request returns when it does
+// not ask for a number
+const defaultThread = 50
+
+// handleThread returns a need together with the most recent messages that
+// reference it, in the order they were stored, and the tree of its
+// sub-needs. Messages addressed to a single agent, such as reminders and
+// conflicts, are only included for that agent and their sender.
+func handleThread(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	needID, _ := req["need_id"].(string)
+	var seq uint64
+	if _, err := fmt.Sscanf(needID, "%d", &seq); err != nil || seq == 0 {
+		_ = msg.Respond([]byte(`{"success": false, "message": "need_id must be a message ID"}`))
+		return
+	}
+	needID = fmt.Sprintf("%d", seq)
+
+	limit := defaultThread
+	if n, ok := req["max"].(float64); ok {
+		if n < 1 {
+			_ = msg.Respond([]byte(`{"success": false, "message": "max must be a positive number"}`))
+			return
+		}
+		limit = int(n)
+	}
+
+	js, _ := nc.JetStream()
+
+	// Replies are always stored after their need, so the scan starts there
+	thread := []map[string]interface{}{}
+	err := scanStream(js, seq, func(m *nats.Msg) bool {
+		entry := mailboxEntry(m)
+		if entry["id"] == needID {
+			if entry["type"] != "need" {
+				return false
+			}
+			thread = append(thread, entry)
+		} else if entry["need_id"] == needID {
+			recipient, _ := entry["recipient"].(string)
+			if recipient != "" && recipient != agentName && entry["sender"] != agentName {
+				return true
+			}
+			thread = append(thread, entry)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Thread scan failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error reading thread"}`))
+		return
+	}
+
+	if len(thread) == 0 || thread[0]["id"] != needID {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Need not found"}`))
+		return
+	}
+
+	// The need's place among other needs: the parent it is part of, the
+	// needs it waits for and its sub-needs, all with their state
+	resp := map[string]interface{}{
+		"success": true,
+		"need_id": needID,
+	}
+	err = withNeedGraph(js, func(graph map[string]*needNode) {
+		node := graph[needID]
+		dependsOn := []NeedSummary{}
+		for _, dep := range node.dependsOn {
+			if _, ok := graph[dep]; ok {
+				dependsOn = append(dependsOn, summary(graph, dep))
+			}
+		}
+		resp["tree"] = summarize(graph, needID)
+		resp["depends_on"] = dependsOn
+		if _, ok := graph[node.parent]; ok {
+			resp["parent"] = summary(graph, node.parent)
+		}
+	})
+	if err != nil {
+		log.Printf("Need graph scan failed: %v", err)
+		_ = msg.Respond([]byte(`{"success": false, "message": "Internal error reading thread"}`))
+		return
+	}
+
+	// The need always leads the thread. Of its replies the newest matter
+	// most, so older ones are cut down to stubs first, and left out once not
+	// even a stub fits in what the rest of the reply leaves.
+	rest, _ := json.Marshal(resp)
+	budget := int(nc.MaxPayload()) - replyOverhead - len(rest)
+	fit := func(entry map[string]interface{}) (map[string]interface{}, bool) {
+		entryData, _ := json.Marshal(entry)
+		if len(entryData)+1 > budget {
+			entry = stubEntry(entry)
+			entryData, _ = json.Marshal(entry)
+		}
+		if len(entryData)+1 > budget {
+			return nil, false
+		}
+		budget -= len(entryData) + 1
+		return entry, true
+	}
+	if need, ok := fit(thread[0]); ok {
+		thread[0] = need
+	}
+	replies := thread[1:]
+	first := len(replies)
+	for first > max(0, len(replies)-limit) {
+		entry, ok := fit(replies[first-1])
+		if !ok {
+			break
+		}
+		replies[first-1] = entry
+		first--
+	}
+
+	resp["messages"] = append([]map[string]interface{}{thread[0]}, replies[first:]...)
+	resp["more"] = first
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
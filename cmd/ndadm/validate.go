@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultTextMax        = 100 // Longest message text, in bytes
+	defaultIDMax          = 50  // Longest need ID or payload reference
+	defaultAttachmentsMax = 32  // Most attachments one message may carry
+	labelMax              = 255 // Longest content type, encoding or attachment name
+)
+
+// Field limits of send requests (config: text-max, id-max, attachments-max)
+var (
+	textMax        = defaultTextMax
+	idMax          = defaultIDMax
+	attachmentsMax = defaultAttachmentsMax
+)
+
+// Codes of field errors. They are part of the response contract, so
+// clients can react to them without parsing messages.
+const (
+	errRequired     = "required"
+	errInvalidType  = "invalid_type"
+	errInvalidValue = "invalid_value"
+	errTooLong      = "too_long"
+	errTooMany      = "too_many"
+	errRateLimited  = "rate_limited"
+	errConflict     = "conflict"
+	errLocked       = "locked"
+)
+
+// fieldError says which field of a request was rejected and why
+type fieldError struct {
+	Code  string `json:"code"`
+	Field string `json:"field"`
+	Limit int    `json:"limit,omitempty"`
+
+	message string // Explanation for the agent
+}
+
+// respondFieldError rejects a request with both a readable message and the
+// structured error
+func respondFieldError(msg *nats.Msg, fe *fieldError) {
+	resp := map[string]interface{}{
+		"success": false,
+		"message": fe.message,
+		"error":   fe,
+	}
+	respData, _ := json.Marshal(resp)
+	_ = msg.Respond(respData)
+}
+
+// stringField returns the value of a string field, or "" if it is absent
+func stringField(req map[string]interface{}, field string) (string, *fieldError) {
+	raw, ok := req[field]
+	if !ok || raw == nil {
+		return "", nil
+	}
+	s, ok := raw.(string)
+	if !ok {
+		return "", &fieldError{Code: errInvalidType, Field: field, message: fmt.Sprintf("Field %s must be a string", field)}
+	}
+	return s, nil
+}
+
+// boundedField returns the value of a string field no longer than limit
+func boundedField(req map[string]interface{}, field string, limit int) (string, *fieldError) {
+	s, fe := stringField(req, field)
+	if fe != nil {
+		return "", fe
+	}
+	if len(s) > limit {
+		return "", &fieldError{Code: errTooLong, Field: field, Limit: limit, message: fmt.Sprintf("Field %s too long (max %d chars)", field, limit)}
+	}
+	return s, nil
+}
+
+// validateSendRequest checks the type, presence and length of every field
+// of a send request before anything is looked up or stored
+func validateSendRequest(req map[string]interface{}) *fieldError {
+	msgType, fe := stringField(req, "type")
+	if fe != nil {
+		return fe
+	}
+	if msgType == "" {
+		return &fieldError{Code: errRequired, Field: "type", message: "Message type is required"}
+	}
+	if !isMessageType(msgType) {
+		return &fieldError{Code: errInvalidValue, Field: "type", message: fmt.Sprintf("Unknown message type '%s' (use %s)", msgType, strings.Join(messageTypes, ", "))}
+	}
+	if msgType == "reminder" || msgType == "overdue" || msgType == "conflict" {
+		return &fieldError{Code: errInvalidValue, Field: "type", message: fmt.Sprintf("A %s is sent by the network, not by agents", msgType)}
+	}
+
+	text, fe := stringField(req, "text")
+	if fe != nil {
+		return fe
+	}
+	if len(text) > textMax {
+		return &fieldError{Code: errTooLong, Field: "text", Limit: textMax, message: fmt.Sprintf("Message too long (max %d chars). Use a short message and put details in --data, e.g.: nd send %s \"<short message>\" --data \"<full details>\"", textMax, msgType)}
+	}
+	switch msgType {
+	case "need", "question", "answer", "progress", "dm":
+		if text == "" {
+			return &fieldError{Code: errRequired, Field: "text", message: fmt.Sprintf("A %s must have a message", msgType)}
+		}
+	}
+
+	needID, fe := stringField(req, "need_id")
+	if fe != nil {
+		return fe
+	}
+	if len(needID) > idMax {
+		if msgType == "intent" {
+			return &fieldError{Code: errTooLong, Field: "need_id", Limit: idMax, message: fmt.Sprintf("Intent need ID too long (max %d chars). Intents should be short - just reference the need ID, e.g.: nd send intent <need-id>", idMax)}
+		}
+		return &fieldError{Code: errTooLong, Field: "need_id", Limit: idMax, message: fmt.Sprintf("Need ID too long (max %d chars)", idMax)}
+	}
+	if isReplyType(msgType) && needID == "" {
+		return &fieldError{Code: errRequired, Field: "need_id", message: fmt.Sprintf("A %s must provide need_id", msgType)}
+	}
+
+	recipient, fe := stringField(req, "recipient")
+	if fe != nil {
+		return fe
+	}
+	if msgType == "dm" && recipient == "" {
+		return &fieldError{Code: errRequired, Field: "recipient", message: "Direct message must provide a recipient"}
+	}
+
+	if _, fe := stringField(req, "data"); fe != nil {
+		return fe
+	}
+	if _, fe := boundedField(req, "data_ref", idMax); fe != nil {
+		return fe
+	}
+	if _, fe := boundedField(req, "content_type", labelMax); fe != nil {
+		return fe
+	}
+	if _, fe := boundedField(req, "encoding", labelMax); fe != nil {
+		return fe
+	}
+
+	if skills, fe := skillsField(req, "skills"); fe != nil {
+		return fe
+	} else if len(skills) > 0 && msgType != "need" {
+		return &fieldError{Code: errInvalidValue, Field: "skills", message: "Only needs can ask for skills"}
+	}
+	if paths, fe := pathsField(req, "paths"); fe != nil {
+		return fe
+	} else if len(paths) > 0 && msgType != "intent" {
+		return &fieldError{Code: errInvalidValue, Field: "paths", message: "Only intents can claim paths"}
+	}
+	if fe := validatePriority(req, msgType); fe != nil {
+		return fe
+	}
+	if fe := validateDeadline(req, msgType); fe != nil {
+		return fe
+	}
+	if fe := validateNeedLinks(req, msgType); fe != nil {
+		return fe
+	}
+
+	return validateAttachments(req)
+}
+
+// validateAttachments checks the shape of the attachments of a send request
+func validateAttachments(req map[string]interface{}) *fieldError {
+	raw, ok := req["attachments"]
+	if !ok || raw == nil {
+		return nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok {
+		return &fieldError{Code: errInvalidType, Field: "attachments", message: "Field attachments must be a list"}
+	}
+	if len(list) > attachmentsMax {
+		return &fieldError{Code: errTooMany, Field: "attachments", Limit: attachmentsMax, message: fmt.Sprintf("Too many attachments (max %d)", attachmentsMax)}
+	}
+	for i, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return &fieldError{Code: errInvalidType, Field: fmt.Sprintf("attachments[%d]", i), message: "Each attachment must be an object with a name and a ref"}
+		}
+		for _, check := range []struct {
+			field string
+			limit int
+		}{{"name", labelMax}, {"ref", idMax}, {"content_type", labelMax}} {
+			if _, fe := boundedField(fields, check.field, check.limit); fe != nil {
+				fe.Field = fmt.Sprintf("attachments[%d].%s", i, fe.Field)
+				return fe
+			}
+		}
+	}
+	return nil
+}
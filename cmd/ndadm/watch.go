@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// watchKeepAlive is how long a watch may stay idle before the watcher
+	// is sent a keepalive, which tells both sides the other is still there
+	watchKeepAlive = 15 * time.Second
+
+	// watchConfirm is how long a watcher has to confirm a delivery or a
+	// keepalive before the watch ends
+	watchConfirm = 5 * time.Second
+)
+
+// watch is a mailbox being pushed to a watcher's inbox
+type watch struct {
+	done     chan struct{} // Closed to end the watch
+	finished chan struct{} // Closed once the watch has let go of the mailbox
+}
+
+// watches holds the running watches by inbox, so a watcher can end its own
+var watches = struct {
+	sync.Mutex
+	byInbox map[string]*watch
+}{byInbox: make(map[string]*watch)}
+
+// handleWatch pushes an agent's mailbox to the inbox named in the request
+// until the watcher stops it or goes away. Every message is sent as a
+// request and only acknowledged once the watcher replies, so a message whose
+// delivery was not confirmed stays in the mailbox for the next watch or read.
+// A stop is answered once the watch has let go of the mailbox, so a read
+// right after it sees every message the watch did not deliver.
+func handleWatch(nc *nats.Conn, msg *nats.Msg) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(msg.Data, &req); err != nil {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Invalid payload"}`))
+		return
+	}
+
+	clientID, _ := req["client_id"].(string)
+	agentName := registry.CheckIn(clientID, time.Now())
+	if agentName == "" {
+		_ = msg.Respond([]byte(`{"success": false, "message": "Not registered. Please register first: nd register --name <your-name>"}`))
+		return
+	}
+
+	// Only reply inboxes, so a watch cannot be pointed at the network's
+	// own subjects
+	inbox, _ := req["inbox"].(string)
+	if !strings.HasPrefix(inbox, nats.InboxPrefix) || strings.ContainsAny(inbox, "*> \t") {
+		_ = msg.Respond([]byte(`{"success": false, "message": "inbox must be a reply inbox to deliver to"}`))
+		return
+	}
+
+	if stop, _ := req["stop"].(bool); stop {
+		watches.Lock()
+		w := watches.byInbox[inbox]
+		delete(watches.byInbox, inbox)
+		watches.Unlock()
+		if w == nil {
+			_ = msg.Respond([]byte(`{"success": true, "message": "Stopped watching"}`))
+			return
+		}
+		close(w.done)
+		go func() {
+			<-w.finished
+			_ = msg.Respond([]byte(`{"success": true, "message": "Stopped watching"}`))
+		}()
+		return
+	}
+
+	// Asking again for a running watch, as after a reconnect, leaves it be
+	watches.Lock()
+	if _, ok := watches.byInbox[inbox]; ok {
+		watches.Unlock()
+		_ = msg.Respond([]byte(`{"success": true, "message": "Watching"}`))
+		return
+	}
+	w := &watch{done: make(chan struct{}), finished: make(chan struct{})}
+	watches.byInbox[inbox] = w
+	watches.Unlock()
+
+	_ = msg.Respond([]byte(`{"success": true, "message": "Watching"}`))
+	fmt.Printf("ndadm: Agent '%s' is watching\n", agentName)
+
+	js, _ := nc.JetStream()
+	deliver := func(entry map[string]interface{}) error {
+		data, _ := json.Marshal(entry)
+		_, err := nc.Request(inbox, data, watchConfirm)
+		return err
+	}
+	keepalive := func() error {
+		_, err := nc.Request(inbox, []byte(`{"keepalive": true}`), watchConfirm)
+		return err
+	}
+	go func() {
+		defer close(w.finished)
+		err := followMailbox(js, agentName, clientID, w.done, deliver, keepalive)
+		if err != nil && !errors.Is(err, nats.ErrNoResponders) && !errors.Is(err, nats.ErrTimeout) {
+			log.Printf("Watch failed: %v", err)
+		}
+		watches.Lock()
+		if watches.byInbox[inbox] == w {
+			delete(watches.byInbox, inbox)
+		}
+		watches.Unlock()
+		fmt.Printf("ndadm: Agent '%s' stopped watching\n", agentName)
+	}()
+}
+
+// followMailbox hands an agent's mailbox to deliver message by message
+// until deliver or keepalive fails or done is closed. keepalive is called
+// whenever nothing was delivered for watchKeepAlive. Following keeps the
+// agent online.
+func followMailbox(js nats.JetStreamContext, agentName, clientID string, done <-chan struct{}, deliver func(entry map[string]interface{}) error, keepalive func() error) error {
+	reader := &mailboxReader{js: js, agentName: agentName}
+	defer reader.close()
+
+	idleSince := time.Now()
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		registry.CheckIn(clientID, time.Now())
+
+		sent, err := deliverBatch(reader, deliver)
+		if err != nil {
+			return err
+		}
+		if sent > 0 {
+			idleSince = time.Now()
+			continue
+		}
+		if time.Since(idleSince) >= watchKeepAlive {
+			if err := keepalive(); err != nil {
+				return err
+			}
+			idleSince = time.Now()
+		}
+	}
+}
+
+// mailboxReader is the pull subscription a watch reads an agent's mailbox
+// through. It is bound once and bound again only after the mailbox was
+// rewound or given new filters.
+type mailboxReader struct {
+	js         nats.JetStreamContext
+	agentName  string
+	sub        *nats.Subscription
+	generation uint64 // Mailbox generation sub was bound at
+}
+
+// bind returns the reader's subscription, binding it first if the mailbox
+// changed since. The caller holds the mailbox.
+func (r *mailboxReader) bind() (*nats.Subscription, error) {
+	if r.sub != nil && r.generation == registry.MailboxGeneration(r.agentName) {
+		return r.sub, nil
+	}
+	r.close()
+
+	sub, err := openMailbox(r.js, r.agentName)
+	if err != nil {
+		return nil, err
+	}
+	// Read after opening, which may have refiltered the mailbox itself
+	r.sub, r.generation = sub, registry.MailboxGeneration(r.agentName)
+	return sub, nil
+}
+
+// close lets go of the reader's subscription; the mailbox itself stays
+func (r *mailboxReader) close() {
+	if r.sub != nil {
+		_ = r.sub.Unsubscribe()
+		r.sub = nil
+	}
+}
+
+// deliverBatch hands the next messages of the agent's mailbox to deliver,
+// waiting up to mailboxPoll for them, and returns how many were delivered.
+// Each message is acknowledged once deliver returns; when it fails, that
+// message and the ones after it go back to the mailbox. The mailbox is held
+// only for this turn, so reads and rewinds can run in between.
+func deliverBatch(reader *mailboxReader, deliver func(entry map[string]interface{}) error) (int, error) {
+	agentName := reader.agentName
+	unlock := registry.ShareMailbox(agentName)
+	defer unlock()
+
+	sub, err := reader.bind()
+	if err != nil {
+		return 0, err
+	}
+
+	msgs, err := fetchMailbox(sub, defaultFetch, mailboxPoll)
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for i, m := range msgs {
+		routedFor, ok := routeFor(agentName, m)
+		if !ok {
+			_ = m.AckSync()
+			continue
+		}
+		entry := mailboxEntry(m)
+		if routedFor != nil {
+			entry["routed_for"] = routedFor
+		}
+		if err := deliver(entry); err != nil {
+			for _, rest := range msgs[i:] {
+				_ = rest.Nak()
+			}
+			return sent, err
+		}
+		_ = m.AckSync()
+		sent++
+	}
+	return sent, nil
+}
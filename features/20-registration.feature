@@ -42,3 +42,69 @@ Feature: Agent Registration
     And I run "nd register --name AgentCharlie"
     Then all registrations should succeed
     And mailboxes for "AgentAlice", "AgentBob", and "AgentCharlie" should exist
+
+  Scenario: Friendly names with spaces and dots get a working mailbox
+    Given a registered agent "Dr. Smith"
+    And a registered agent "AgentBob"
+    And agent "AgentBob" has sent a need "fix the bug"
+    When agent "Dr. Smith" runs "nd receive"
+    Then the output should contain "fix the bug"
+    When agent "Dr. Smith" runs "nd send intent 1"
+    Then the command should succeed
+
+  Scenario: Names that cannot be used are rejected at registration
+    Given the network is up
+    When I run "nd register --name agent*"
+    Then the output should contain "Invalid agent name 'agent*'"
+    And the command should fail
+
+  Scenario: The server's own name is reserved
+    Given the network is up
+    When I run "nd register --name NDADM"
+    Then the output should contain "Agent name 'NDADM' is reserved"
+    And the command should fail
+
+  Scenario: Agents describe themselves and find each other
+    Given the network is up
+    When I run "nd register --name AgentAlice --describe Backend --skill Go --skill sql --model gpt-5"
+    Then the output should contain "Registered AgentAlice successfully"
+    Given a registered agent "AgentBob"
+    When agent "AgentBob" runs "nd profile set --describe 'Writes the docs' --skill markdown"
+    Then the output should contain "Profile updated"
+    When agent "AgentBob" runs "nd agents"
+    Then the output should contain "AgentAlice (online) - Backend"
+    And the output should contain "skills: go, sql"
+    And the output should contain "AgentBob (online) - Writes the docs"
+    When agent "AgentBob" runs "nd agents --skill go --output json"
+    Then the output should contain "AgentAlice"
+    And the output should not contain "Writes the docs"
+
+  Scenario: Invalid skills are rejected
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd profile set --skill 'two words'"
+    Then the command should fail with "Invalid skill 'two words'"
+
+  Scenario: The agent directory shows who is online
+    Given the server runs with "presence-online=2"
+    And a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentBob" runs "nd agents"
+    Then the output should contain "AgentAlice (online)"
+    When agent "AgentBob" runs "nd receive --timeout 3s"
+    And agent "AgentBob" runs "nd agents"
+    Then the output should contain "AgentAlice (idle, last seen"
+    And the output should contain "AgentBob (online)"
+    When agent "AgentAlice" runs "nd heartbeat"
+    Then the output should contain "AgentAlice is online. 1 other agent(s) online."
+    When agent "AgentBob" runs "nd agents --output json"
+    Then the output should contain "online"
+    And the output should not contain "idle"
+
+  Scenario: Sending a need warns when nobody else is online
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'anyone there?'"
+    Then the command should succeed
+    And the output should contain "Warning: No other agent is online right now"
+    Given a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'fix the bug'"
+    Then the output should not contain "Warning"
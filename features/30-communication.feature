@@ -23,3 +23,483 @@ Feature: Agent Communication
     When agent "AgentBob" runs "nd send intent 'fix the bug'"
     And agent "AgentBob" runs "nd send solution 'fix the bug' 'fixed it'"
     Then the command should succeed
+
+  Scenario: Viewing the conversation thread of a need
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentAlice" has sent a need "unrelated work"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send solution 1 'fixed it' --data 'patch'"
+    When agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "NEED from AgentAlice"
+    And the output should contain "INTENT from AgentBob"
+    And the output should contain "SOLUTION from AgentBob"
+    And the output should not contain "unrelated work"
+
+  Scenario: Direct messages reach only the recipient
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    When agent "AgentAlice" runs "nd send dm AgentBob 'which branch?'"
+    Then the command should succeed
+    And agent "AgentBob" should receive a message with text "which branch?"
+    When agent "AgentCarol" runs "nd receive"
+    Then the output should not contain "which branch?"
+    When agent "AgentCarol" runs "nd get 1"
+    Then the command should fail with "Message not found"
+    When agent "AgentAlice" runs "nd get 1"
+    Then the output should contain "which branch?"
+
+  Scenario: Direct messages are kept in the sender's history
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentBob" has sent a need "not mine"
+    When agent "AgentAlice" runs "nd send dm AgentBob 'which branch?'"
+    And agent "AgentAlice" runs "nd history"
+    Then the output should contain "which branch?"
+    And the output should not contain "not mine"
+    When agent "AgentBob" runs "nd history"
+    Then the output should contain "not mine"
+    And the output should not contain "which branch?"
+
+  Scenario: Direct messages need a registered recipient
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send dm AgentNobody 'hello'"
+    Then the command should fail with "Unknown agent 'AgentNobody'"
+
+  Scenario: Asking about a need and reporting progress
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send question 1 'which branch?'"
+    And agent "AgentAlice" runs "nd send answer 1 'use main'"
+    And agent "AgentBob" runs "nd send progress 1 'half done'"
+    When agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "QUESTION from AgentBob"
+    And the output should contain "ANSWER from AgentAlice"
+    And the output should contain "PROGRESS from AgentBob"
+
+  Scenario: Questions require intent and answers require ownership
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentBob" runs "nd send question 1 'which branch?'"
+    Then the command should fail with "You must first announce intent"
+    When agent "AgentBob" runs "nd send answer 1 'use main'"
+    Then the command should fail with "Only the owner of the need can answer"
+
+  Scenario: Asking waits for the solution to the need
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" starts "nd ask 'fix the bug' --timeout 10s" in the background
+    And agent "AgentBob" runs "nd receive --timeout 5s"
+    And agent "AgentAlice" has sent a need "unrelated work"
+    When agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send solution 1 'done' --data 'the answer'"
+    Then the background command of agent "AgentAlice" should output "the answer"
+
+  Scenario: Asking gives up after the timeout
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd ask 'fix the bug' --timeout 1s"
+    Then the command should exit with code 4
+    When agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "CANCEL from AgentAlice"
+    And the output should contain "No longer waiting for a solution"
+
+  Scenario: Large payloads are stored out of line and fetched back
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'read this log' --data $(head -c 100000 /dev/zero | tr '\0' x)"
+    When agent "AgentBob" runs "nd receive --output json"
+    Then the output should contain "data_ref"
+    When agent "AgentBob" runs "nd get 1 | wc -c"
+    Then the output should contain "100000"
+
+  Scenario: Sending a payload from a file
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "head -c 2000000 /dev/zero | tr '\0' x > big.log && nd send need 'read this log' --data-file big.log; rm -f big.log"
+    When agent "AgentBob" runs "nd get 1 | wc -c"
+    Then the output should contain "2000000"
+
+  Scenario: Sending a payload from stdin
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "echo 'piped details' | nd send need 'read this' --data -"
+    When agent "AgentBob" runs "nd get 1"
+    Then the output should contain "piped details"
+
+  Scenario: Attachments are saved under their original names
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "echo 'first' > notes.txt && echo 'second' > trace.log && nd send need 'see files' --attach notes.txt --attach trace.log; rm -f notes.txt trace.log"
+    When agent "AgentBob" runs "nd get 1 --save-dir out && cat out/notes.txt out/trace.log; rm -rf out"
+    Then the output should contain "Saved out/notes.txt"
+    And the output should contain "first"
+    And the output should contain "second"
+
+  Scenario: Payloads over the limit are refused before they are uploaded
+    Given the server runs with "payload-max=1000"
+    And a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "head -c 2000 /dev/zero > big.log && nd send need 'read this log' --attach big.log; rm -f big.log"
+    Then the output should contain "payload too large (2000 bytes, max 1000 bytes)"
+    And the payload store should hold 0 objects
+
+  Scenario: Uploads for a refused message are removed
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "echo 'first' > notes.txt && nd send need 'see files' --attach notes.txt --parent 99; rm -f notes.txt"
+    Then the output should contain "Need 99 not found"
+    And the payload store should hold 0 objects
+
+  Scenario: Attachments with the same file name are refused
+    Given a registered agent "AgentAlice"
+    And agent "AgentAlice" runs "mkdir -p a b && echo 'one' > a/x.txt && echo 'two' > b/x.txt && nd send need 'see files' --attach a/x.txt --attach b/x.txt; rm -rf a b"
+    Then the output should contain "attachments need distinct file names"
+
+  Scenario: Binary payloads survive the round trip
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "printf '\x89PNG\r\n\x1a\n\x00\xff' > image.png && nd send need 'look at this' --data-file image.png; rm -f image.png"
+    When agent "AgentBob" runs "nd receive --output json"
+    Then the output should contain "image/png"
+    And the output should contain "base64"
+    When agent "AgentBob" runs "nd get 1 | od -An -tx1 | tr -d ' \n'"
+    Then the output should contain "89504e470d0a1a0a00ff"
+
+  Scenario: JSON payloads are labelled and validated
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'use these settings' --data '[1, 2, 3]'"
+    When agent "AgentBob" runs "nd receive --output json"
+    Then the output should contain "application/json"
+    When agent "AgentAlice" runs "nd send need 'use these settings' --data 'retries=3' --content-type application/json"
+    Then the command should fail with "not valid JSON"
+
+  Scenario: Applying a solution that carries a patch
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has a git checkout with "greeting.txt" containing "hello"
+    And agent "AgentBob" has a git checkout with "greeting.txt" containing "hello"
+    And agent "AgentAlice" has sent a need "greet the world"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "echo 'hello world' > greeting.txt && nd send solution 1 'greeting fixed' --git-diff" in their checkout
+    When agent "AgentAlice" runs "nd apply 3 --dry-run" in their checkout
+    Then the output should contain "applies cleanly"
+    And the output should contain "greeting.txt"
+    When agent "AgentAlice" runs "nd apply 3 && cat greeting.txt" in their checkout
+    Then the output should contain "Applied solution 3"
+    And the output should contain "hello world"
+
+  Scenario: A patch that does not apply is reported without changes
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has a git checkout with "greeting.txt" containing "goodbye"
+    And agent "AgentBob" has a git checkout with "greeting.txt" containing "hello"
+    And agent "AgentAlice" has sent a need "greet the world"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "echo 'hello world' > greeting.txt && nd send solution 1 --git-diff" in their checkout
+    When agent "AgentAlice" runs "nd apply 3" in their checkout
+    Then the command should fail with "does not apply cleanly"
+    And the command should exit with code 5
+    And the output should contain "patch failed: greeting.txt"
+    When agent "AgentAlice" runs "nd apply 3 --output json" in their checkout
+    Then the command should exit with code 5
+    And the JSON field "applied" should be "false"
+    And the output should contain "patch failed: greeting.txt"
+
+  Scenario: The server validates requests that bypass nd
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" sends this request to "needy.send":
+      """
+      {"type": "need", "data": "details without a message"}
+      """
+    Then the output should contain "A need must have a message"
+    And the output should contain "required"
+    When agent "AgentAlice" sends this request to "needy.send":
+      """
+      {"type": "need", "text": 42}
+      """
+    Then the output should contain "invalid_type"
+
+  Scenario: Message limits are configured on the server
+    Given the server runs with "text-max=10"
+    And a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'longer than ten' --output json"
+    Then the command should exit with code 1
+    And the output should contain "too_long"
+    And the output should contain "max 10 chars"
+
+  Scenario: Needs asking for a skill reach only agents that have it
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentBob" runs "nd profile set --skill terraform"
+    When agent "AgentAlice" runs "nd send need 'plan the VPC change' --skill terraform"
+    Then the output should contain "Routed to AgentBob (skills: terraform)"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "plan the VPC change (routed to you for terraform)"
+    When agent "AgentCarol" runs "nd receive"
+    Then the output should not contain "plan the VPC change"
+
+  Scenario: Needs routed to other agents take no place in a read
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentBob" runs "nd profile set --skill terraform"
+    And agent "AgentAlice" runs "nd send need 'plan the VPC change' --skill terraform"
+    And agent "AgentAlice" has sent a need "write the docs"
+    And agent "AgentAlice" runs "nd send need 'plan the DNS change' --skill terraform"
+    When agent "AgentCarol" runs "nd receive --max 1 --output json"
+    Then the output should contain "write the docs"
+    And the JSON field "pending" should be "0"
+
+  Scenario: Needs routed to other agents stay out of the count after a restart
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentBob" runs "nd profile set --skill terraform"
+    And agent "AgentAlice" has sent a need "write the docs"
+    And agent "AgentAlice" runs "nd send need 'plan the VPC change' --skill terraform"
+    When the server restarts
+    And agent "AgentCarol" runs "nd register --name AgentCarol"
+    And agent "AgentCarol" runs "nd receive --peek --output json"
+    Then the output should contain "write the docs"
+    And the JSON field "pending" should be "0"
+
+  Scenario: Needs asking for a skill nobody has are broadcast
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'port it to COBOL' --skill cobol"
+    Then the output should contain "No other agent advertises cobol, so the need went to everyone"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "port it to COBOL (asks for cobol)"
+
+  Scenario: Higher-priority needs are read first
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'tidy the changelog' --priority low"
+    And agent "AgentAlice" runs "nd send need 'update the docs'"
+    And agent "AgentAlice" runs "nd send need 'prod is down' --priority high"
+    And agent "AgentBob" runs "nd receive --max 1"
+    Then the output should contain "prod is down (high priority)"
+    And the output should not contain "update the docs"
+    When agent "AgentBob" runs "nd receive --peek"
+    Then the output should show "update the docs" before "tidy the changelog"
+    And the output should not contain "prod is down"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should show "update the docs" before "tidy the changelog (low priority)"
+
+  Scenario: Replies stay in order within a need's thread
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'tidy the changelog' --priority low"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentAlice" runs "nd send need 'prod is down' --priority high"
+    And agent "AgentBob" runs "nd send progress 1 'halfway there'"
+    And agent "AgentAlice" runs "nd receive"
+    Then the output should show "prod is down" before "tidy the changelog"
+    And the output should show "tidy the changelog" before "halfway there"
+
+  Scenario: High-priority needs are limited per hour
+    Given the server runs with "high-priority-per-hour=1"
+    And a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'prod is down' --priority high"
+    Then the command should succeed
+    When agent "AgentAlice" runs "nd send need 'staging is down too' --priority high --output json"
+    Then the command should exit with code 1
+    And the output should contain "rate_limited"
+    And the output should contain "max 1 per hour"
+    When agent "AgentAlice" runs "nd send need 'staging is down too' --priority normal"
+    Then the command should succeed
+
+  Scenario: Refused high-priority needs do not count against the limit
+    Given the server runs with "high-priority-per-hour=1"
+    And a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'prod is down' --priority high --parent 99"
+    Then the command should exit with code 1
+    When agent "AgentAlice" runs "nd send need 'prod is down' --priority high"
+    Then the command should succeed
+
+  Scenario: Deadlines remind agents working on a need and tell the owner when missed
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'ship the release' --deadline 3s"
+    Then the output should contain "Due at"
+    When agent "AgentBob" runs "nd needs"
+    Then the output should contain "ship the release (due in"
+    When agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd receive"
+    And agent "AgentBob" runs "nd receive --timeout 5s"
+    Then the output should contain "REMINDER from ndadm on need 1: Need 1 is due in"
+    When agent "AgentAlice" runs "nd receive"
+    And agent "AgentAlice" runs "nd receive --timeout 5s"
+    Then the output should contain "OVERDUE from ndadm on need 1"
+    When agent "AgentAlice" runs "nd needs"
+    Then the output should contain "ship the release (overdue by"
+    When agent "AgentBob" runs "nd thread 1"
+    Then the output should contain "REMINDER from ndadm"
+    And the output should not contain "OVERDUE"
+    When agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "OVERDUE from ndadm"
+    And the output should not contain "REMINDER"
+
+  Scenario: Deadlines are still watched after the server restarts
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'ship the release' --deadline 3s"
+    And the server restarts
+    And agent "AgentAlice" runs "nd register --name AgentAlice"
+    And agent "AgentAlice" runs "nd receive"
+    And agent "AgentAlice" runs "nd receive --timeout 5s"
+    Then the output should contain "OVERDUE from ndadm on need 1"
+
+  Scenario: Solved needs drop off the list of open needs
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --deadline 1h"
+    And agent "AgentAlice" runs "nd send need 'write the docs'"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send solution 1 'fixed it'"
+    And agent "AgentBob" runs "nd needs"
+    Then the output should contain "write the docs"
+    And the output should not contain "fix the bug"
+
+  Scenario: The list of open needs is capped and leaves out needs routed elsewhere
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentBob" runs "nd profile set --skill terraform"
+    When agent "AgentAlice" runs "nd send need 'plan the VPC change' --skill terraform"
+    And agent "AgentAlice" runs "nd send need 'fix the bug'"
+    And agent "AgentAlice" runs "nd send need 'write the docs' --deadline 1h"
+    And agent "AgentCarol" runs "nd needs"
+    Then the output should contain "fix the bug"
+    And the output should not contain "plan the VPC change"
+    When agent "AgentBob" runs "nd needs --max 1"
+    Then the output should contain "write the docs"
+    And the output should not contain "fix the bug"
+    And the output should contain "2 more open need(s) not shown"
+    When agent "AgentBob" runs "nd needs --max 1 --output json"
+    Then the JSON field "more" should be "2"
+
+  Scenario: Only needs take a deadline, and it must be in the future
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --deadline 2020-01-01T00:00:00Z"
+    Then the command should exit with code 2
+    And the output should contain "--deadline must be in the future"
+    When agent "AgentAlice" runs "nd send dm AgentAlice 'hello' --deadline 5m"
+    Then the command should exit with code 2
+    And the output should contain "--deadline is only for needs"
+
+  Scenario: Intents claiming overlapping paths warn both agents
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentAlice" runs "nd send need 'fix the client'"
+    And agent "AgentAlice" runs "nd send need 'add a flag to nd'"
+    And agent "AgentBob" runs "nd send intent 1 --paths 'cmd/nd/**'"
+    And agent "AgentAlice" runs "nd receive --all"
+    And the output should contain "(touches cmd/nd/**)"
+    And agent "AgentBob" runs "nd receive --all"
+    When agent "AgentCarol" runs "nd send intent 2 --paths 'README.md,cmd/nd/main.go'"
+    Then the command should succeed
+    And the output should contain "Warning: AgentBob is working on cmd/nd/** for need 1"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "CONFLICT from ndadm on need 1: AgentCarol is working on README.md, cmd/nd/main.go for need 2"
+
+  Scenario: Paths that do not overlap, or were released, raise no warning
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentAlice" runs "nd send need 'fix the client'"
+    And agent "AgentAlice" runs "nd send need 'fix the server'"
+    And agent "AgentBob" runs "nd send intent 1 --paths 'cmd/nd/*.go'"
+    When agent "AgentCarol" runs "nd send intent 2 --paths 'cmd/ndadm/**' --output json"
+    Then the output should not contain "conflicts"
+    When agent "AgentBob" runs "nd send withdraw 1"
+    And agent "AgentCarol" runs "nd send intent 2 --paths 'cmd/**'"
+    Then the output should not contain "Warning"
+
+  Scenario: A solution releases every claim on its need
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And a registered agent "AgentDave"
+    And agent "AgentAlice" runs "nd send need 'fix the client'"
+    And agent "AgentAlice" runs "nd send need 'fix the server'"
+    And agent "AgentBob" runs "nd send intent 1 --paths 'cmd/nd/*.go'"
+    And agent "AgentDave" runs "nd send intent 1 --paths 'cmd/nd/main.go'"
+    When agent "AgentBob" runs "nd send solution 1 'fixed'"
+    And agent "AgentCarol" runs "nd send intent 2 --paths 'cmd/**'"
+    Then the command should succeed
+    And the output should not contain "Warning"
+
+  Scenario: Only intents claim paths
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --paths 'cmd/**'"
+    Then the command should exit with code 2
+    And the output should contain "--paths is only for intents"
+
+  Scenario: Long threads show their most recent replies
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'fix the bug'"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send progress 1 'reproduced it'"
+    And agent "AgentBob" runs "nd send progress 1 'found the cause'"
+    When agent "AgentAlice" runs "nd thread 1 --max 1"
+    Then the output should contain "fix the bug"
+    And the output should contain "found the cause"
+    And the output should not contain "reproduced it"
+    And the output should contain "2 earlier message(s) not shown"
+    When agent "AgentAlice" runs "nd thread 1 --max 1 --output json"
+    Then the JSON field "more" should be "2"
+
+  Scenario: Sub-needs roll up into the thread of their parent
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'ship v2'"
+    And agent "AgentAlice" runs "nd send need 'fix the client' --parent 1"
+    And agent "AgentAlice" runs "nd send need 'fix the server' --parent 1"
+    And agent "AgentAlice" runs "nd send need 'update the docs' --parent 3"
+    When agent "AgentBob" runs "nd receive --all"
+    Then the output should contain "fix the client (part of need 1)"
+    When agent "AgentBob" runs "nd send intent 2"
+    And agent "AgentBob" runs "nd send solution 2 'fixed'"
+    And agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "[1] ship v2 (in progress, 1 of 2 sub-needs solved) from AgentAlice"
+    And the output should contain "    [2] fix the client (solved) from AgentAlice"
+    And the output should contain "    [3] fix the server (open, 0 of 1 sub-needs solved) from AgentAlice"
+    And the output should contain "      [4] update the docs (open) from AgentAlice"
+    When agent "AgentAlice" runs "nd thread 4"
+    Then the output should contain "Part of:"
+    And the output should contain "[3] fix the server"
+
+  Scenario: A need cannot be solved before the needs it depends on
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'write the migration'"
+    And agent "AgentAlice" runs "nd send need 'deploy' --depends-on 1"
+    And the output should contain "It can only be solved once need(s) 1 are."
+    And agent "AgentBob" runs "nd send intent 2"
+    When agent "AgentBob" runs "nd send solution 2 'deployed'"
+    Then the command should fail with "depends on need(s) 1, which have no solution yet"
+    When agent "AgentBob" runs "nd thread 2"
+    Then the output should contain "Need 2 is blocked."
+    And the output should contain "[1] write the migration (open) from AgentAlice"
+    When agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send solution 1 'migrated'"
+    And agent "AgentBob" runs "nd send solution 2 'deployed'"
+    Then the command should succeed
+
+  Scenario: Sub-needs and dependencies must name existing needs
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --parent 99"
+    Then the command should fail with "Need 99 not found"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --depends-on abc"
+    Then the command should exit with code 1
+    And the output should contain "must be a list of need IDs"
+    When agent "AgentAlice" runs "nd send dm AgentAlice 'hello' --parent 1"
+    Then the command should exit with code 2
+    And the output should contain "--parent and --depends-on are only for needs"
@@ -0,0 +1,177 @@
+Feature: Mailbox Delivery
+  As an AI agent
+  I want to follow my mailbox without repeatedly polling it
+  So that I react to new messages as soon as they arrive
+
+  Scenario: Watching streams messages from the mailbox
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentBob" runs "nd watch --timeout 1s"
+    Then the output should contain "fix the bug"
+
+  Scenario: Watching advances the mailbox position
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentBob" runs "nd watch --timeout 1s"
+    And agent "AgentBob" runs "nd receive"
+    Then the output should contain "No new messages"
+
+  Scenario: Watching over Server-Sent Events keeps following after a rewind
+    Given the server runs with "http-port=14280"
+    And a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentBob" starts "curl -sN --max-time 4 http://127.0.0.1:14280/watch?client_id=$(sed -n s/^client-id=//p .needy.conf) || true" in the background
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentBob" runs "nd rewind --to 1"
+    And agent "AgentAlice" has sent a need "update the docs"
+    Then the background command of agent "AgentBob" should output "event: message"
+    And the output should contain "fix the bug"
+    And the output should contain "update the docs"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "No new messages"
+
+  Scenario: Messages stored before per-type subjects are still delivered
+    Given a registered agent "AgentBob"
+    And this message is stored on "needy.messages":
+      """
+      {"type": "need", "sender": "AgentAlice", "text": "legacy task", "timestamp": 1735689600}
+      """
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "legacy task"
+    When agent "AgentBob" runs "nd thread 1"
+    Then the output should contain "legacy task"
+
+  Scenario: Reading a limited number of messages reports what is left
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "first task"
+    And agent "AgentAlice" has sent a need "second task"
+    And agent "AgentAlice" has sent a need "third task"
+    When agent "AgentBob" runs "nd receive --max 2"
+    Then the output should contain "second task"
+    And the output should not contain "third task"
+    And the output should contain "1 more message(s) waiting"
+
+  Scenario: Reading zero messages is refused
+    Given a registered agent "AgentBob"
+    When agent "AgentBob" runs "nd receive --max 0"
+    Then the output should contain "--max must be a positive number"
+    And the command should exit with code 2
+
+  Scenario: Reading the whole mailbox
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "first task"
+    And agent "AgentAlice" has sent a need "second task"
+    And agent "AgentAlice" has sent a need "third task"
+    When agent "AgentBob" runs "nd receive --max 1 --all --output json"
+    Then the output should contain "third task"
+    And the JSON field "pending" should be "0"
+
+  Scenario: Peeking leaves messages unread
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentBob" runs "nd receive --peek"
+    Then the output should contain "fix the bug"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "fix the bug"
+
+  Scenario: Rewinding to a message replays it
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentBob" runs "nd receive"
+    When agent "AgentBob" runs "nd rewind --to 1"
+    Then the output should contain "Mailbox rewound to message 1"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "fix the bug"
+
+  Scenario: Rewinding replays messages that were read ahead
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'update the docs'"
+    And agent "AgentAlice" runs "nd send need 'prod is down' --priority high"
+    And agent "AgentBob" runs "nd receive --max 1"
+    When agent "AgentBob" runs "nd rewind --to 1"
+    And agent "AgentBob" runs "nd receive --peek"
+    Then the output should contain "update the docs"
+    And the output should contain "prod is down"
+
+  Scenario: Rewinding by time replays recent traffic
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentBob" runs "nd receive"
+    When agent "AgentBob" runs "nd rewind --since 1h"
+    And agent "AgentBob" runs "nd receive"
+    Then the output should contain "fix the bug"
+
+  Scenario: Subscribing to needs only
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentBob" runs "nd subscribe --types need"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentBob" runs "nd send intent 1"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "fix the bug"
+    And the output should not contain "INTENT"
+
+  Scenario: Subscribing to replies to my own needs
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And a registered agent "AgentCarol"
+    And agent "AgentAlice" runs "nd subscribe --mine"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentCarol" has sent a need "write the docs"
+    And agent "AgentBob" runs "nd send intent 1"
+    And agent "AgentBob" runs "nd send intent 2"
+    And agent "AgentBob" runs "nd send solution 1 'bug fixed'"
+    And agent "AgentBob" runs "nd send solution 2 'docs written'"
+    When agent "AgentAlice" runs "nd receive"
+    Then the output should contain "write the docs"
+    And the output should contain "bug fixed"
+    And the output should not contain "docs written"
+
+  Scenario: Mailboxes from older servers receive new message types
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And the mailbox of agent "AgentBob" filters on "needy.messages.need.>,needy.messages.intent.>,needy.messages.solution.>"
+    When agent "AgentAlice" runs "nd send dm AgentBob 'which branch?'"
+    And agent "AgentBob" runs "nd receive"
+    Then the output should contain "which branch?"
+
+  Scenario: Subscriptions from older servers are kept
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And the mailbox of agent "AgentBob" filters on "needy.messages.need.>"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    When agent "AgentAlice" runs "nd send dm AgentBob 'which branch?'"
+    And agent "AgentBob" runs "nd receive"
+    Then the output should contain "fix the bug"
+    And the output should not contain "which branch?"
+
+  Scenario: Serving matching needs with a handler
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'shout this #upper' --data 'hello'"
+    And agent "AgentAlice" has sent a need "unrelated work"
+    When agent "AgentBob" runs "nd serve --match '#upper' --exec 'tr a-z A-Z' --timeout 2s"
+    Then the output should contain "Solved need 1"
+    And the output should not contain "need 2"
+    When agent "AgentBob" runs "nd receive"
+    Then the output should contain "unrelated work"
+    And the output should not contain "shout this"
+    When agent "AgentAlice" runs "nd get 4"
+    Then the output should contain "HELLO"
+
+  Scenario: A failing handler withdraws from the need
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "impossible task"
+    When agent "AgentBob" runs "nd serve --exec 'exit 1' --timeout 2s"
+    Then the output should contain "Withdrew from need 1"
+    When agent "AgentAlice" runs "nd thread 1"
+    Then the output should contain "WITHDRAW from AgentBob"
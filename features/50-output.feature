@@ -0,0 +1,44 @@
+Feature: Machine-readable Output
+  As a script driving an AI agent
+  I want nd to emit structured records and stable exit codes
+  So that I can act on messages without parsing prose
+
+  Scenario: Receiving messages as JSON
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'fix the bug' --data 'bug details'"
+    When agent "AgentBob" runs "nd receive --output json"
+    Then the output should be valid JSON
+    And the output should contain "AgentAlice"
+    And the output should contain "bug details"
+    And the output should not contain "nd send intent"
+
+  Scenario: Receiving messages as JSON lines
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" has sent a need "fix the bug"
+    And agent "AgentAlice" has sent a need "write the docs"
+    When agent "AgentBob" runs "nd receive --output jsonl"
+    Then every output line should be valid JSON
+    And the output should contain "write the docs"
+
+  Scenario: Sending reports the new message ID
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send need 'fix the bug' --output json"
+    Then the output should be valid JSON
+    And the JSON field "id" should be "1"
+    And the JSON field "type" should be "need"
+
+  Scenario: Errors are structured and carry documented exit codes
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd send intent --output json"
+    Then the output should be valid JSON
+    And the command should exit with code 2
+
+  Scenario: Text that looks like the output flag is sent as it is
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd send need 'fix the bug' --data -o"
+    When agent "AgentBob" runs "nd -o json receive"
+    Then the output should be valid JSON
+    And the output should contain "-o"
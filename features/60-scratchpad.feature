@@ -0,0 +1,69 @@
+Feature: Shared Scratchpad
+  As an AI agent working alongside others
+  I want to share small pieces of state under well-known keys
+  So that other agents can read them without waiting for a message
+
+  Scenario: Setting a key and reading it back
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd kv set ci.test-command 'make test'"
+    And the output should contain "Set ci.test-command (revision 1)"
+    When agent "AgentBob" runs "nd kv get ci.test-command"
+    Then the command should succeed
+    And the output should contain "make test"
+
+  Scenario: Reading a key that was never set
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd kv get nothing.here"
+    Then the command should fail with "key 'nothing.here' not found"
+
+  Scenario: Only the owner of a key may change it
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd kv set branch main"
+    When agent "AgentBob" runs "nd kv set branch dev"
+    Then the command should fail with "belongs to AgentAlice"
+
+  Scenario: Writing only if the key has not changed
+    Given a registered agent "AgentAlice"
+    And agent "AgentAlice" runs "nd kv set branch main"
+    And agent "AgentAlice" runs "nd kv set branch dev --if-revision 1"
+    And the output should contain "Set branch (revision 2)"
+    When agent "AgentAlice" runs "nd kv set branch release --if-revision 1 --output json"
+    Then the command should exit with code 1
+    And the output should contain "conflict"
+    And the output should contain "revision 2"
+
+  Scenario: Keeping the history of a key
+    Given a registered agent "AgentAlice"
+    And agent "AgentAlice" runs "nd kv set branch main"
+    And agent "AgentAlice" runs "nd kv set branch dev"
+    When agent "AgentAlice" runs "nd kv get branch --history"
+    Then the command should succeed
+    And the output should show "branch = main (revision 1 by AgentAlice)" before "branch = dev (revision 2 by AgentAlice)"
+
+  Scenario: Listing keys by prefix
+    Given a registered agent "AgentAlice"
+    And agent "AgentAlice" runs "nd kv set ci.test-command 'make test'"
+    And agent "AgentAlice" runs "nd kv set branch main"
+    When agent "AgentAlice" runs "nd kv list ci."
+    Then the command should succeed
+    And the output should contain "ci.test-command = make test"
+    And the output should not contain "branch"
+
+  Scenario: Deleting a key frees it for others
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd kv set branch main"
+    And agent "AgentAlice" runs "nd kv delete branch"
+    And the output should contain "Deleted branch"
+    When agent "AgentBob" runs "nd kv set branch dev"
+    Then the command should succeed
+    And the output should contain "Set branch"
+
+  Scenario: Watching a key for changes
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentBob" starts "nd kv watch branch --timeout 3s" in the background
+    When agent "AgentAlice" runs "nd kv set branch main"
+    Then the background command of agent "AgentBob" should output "branch = main (revision 1 by AgentAlice)"
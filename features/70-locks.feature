@@ -0,0 +1,82 @@
+Feature: Locks
+  As an AI agent editing a repository others work in too
+  I want to claim files before changing them
+  So that we do not overwrite each other's edits
+
+  Scenario: Locking a file
+    Given a registered agent "AgentAlice"
+    When agent "AgentAlice" runs "nd lock acquire src/main.go --ttl 10m"
+    Then the command should succeed
+    And the output should contain "Locked src/main.go (token 1) for 10m0s"
+    And the output should contain "nd lock release src/main.go"
+
+  Scenario: A locked file cannot be claimed by another agent
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    When agent "AgentBob" runs "nd lock acquire src/main.go --output json"
+    Then the command should exit with code 1
+    And the output should contain "locked by AgentAlice"
+    And the output should contain "nd lock wait src/main.go"
+    And the output should contain "field_error"
+
+  Scenario: Acquiring a lock again renews it
+    Given a registered agent "AgentAlice"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go --ttl 1m"
+    When agent "AgentAlice" runs "nd lock acquire src/main.go --ttl 5m"
+    Then the command should succeed
+    And the output should contain "Renewed the lock on src/main.go (token 1) for 5m0s"
+
+  Scenario: Releasing a lock hands out a new fencing token to the next holder
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    And agent "AgentAlice" runs "nd lock release src/main.go"
+    And the output should contain "Released src/main.go"
+    When agent "AgentBob" runs "nd lock acquire src/main.go"
+    Then the command should succeed
+    And the output should contain "token 2"
+
+  Scenario: Only the holder may release a lock
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    When agent "AgentBob" runs "nd lock release src/main.go"
+    Then the command should fail with "locked by AgentAlice, not you"
+
+  Scenario: An expired lease frees the resource
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire deploy --ttl 1s"
+    When agent "AgentBob" runs "nd lock wait deploy --timeout 10s"
+    Then the command should succeed
+    And the output should contain "Locked deploy (token 2)"
+
+  Scenario: Waiting for a lock until it is released
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    And agent "AgentBob" starts "nd lock wait src/main.go --timeout 10s" in the background
+    When agent "AgentAlice" runs "nd lock release src/main.go"
+    Then the background command of agent "AgentBob" should output "Locked src/main.go (token 2)"
+
+  Scenario: Giving up waiting for a lock
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    When agent "AgentBob" runs "nd lock wait src/main.go --timeout 1s"
+    Then the command should exit with code 4
+    And the output should contain "still locked by AgentAlice"
+
+  Scenario: Listing locks
+    Given a registered agent "AgentAlice"
+    And a registered agent "AgentBob"
+    And agent "AgentAlice" runs "nd lock acquire src/main.go"
+    And agent "AgentBob" runs "nd lock acquire .github/workflows/ci.yml"
+    And agent "AgentBob" runs "nd lock acquire README.md"
+    And agent "AgentBob" runs "nd lock release README.md"
+    When agent "AgentAlice" runs "nd lock list"
+    Then the command should succeed
+    And the output should contain "src/main.go locked by AgentAlice (token 1"
+    And the output should contain ".github/workflows/ci.yml locked by AgentBob"
+    And the output should not contain "README.md"
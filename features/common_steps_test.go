@@ -2,6 +2,7 @@ package features
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -37,16 +38,22 @@ func runCmd(path string, args ...string) error {
 	return nil
 }
 
-func writeTestConfig() {
-	_ = os.WriteFile(".needy.conf", []byte(fmt.Sprintf("port=%d\n", testPort)), 0600)
+// writeTestConfig writes a config with the test port and any extra
+// key=value settings
+func writeTestConfig(settings ...string) {
+	conf := fmt.Sprintf("port=%d\n", testPort)
+	for _, setting := range settings {
+		conf += setting + "\n"
+	}
+	_ = os.WriteFile(".needy.conf", []byte(conf), 0600)
 }
 
-func startNdadmServer() {
+func startNdadmServer(settings ...string) {
 	// Stop our own test server if still running from a previous scenario
 	stopNdadmServer()
 
 	// Write config so ndadm uses test port
-	writeTestConfig()
+	writeTestConfig(settings...)
 
 	// Wait for port to be free
 	waitForPortFree(testPort)
@@ -120,6 +127,28 @@ func InitializeCommonSteps(ctx *godog.ScenarioContext) {
 	ctx.Step(`^I run "([^"]*)"$`, iRun)
 	ctx.Step(`^the output should contain "([^"]*)"$`, theOutputShouldContain)
 	ctx.Step(`^the command should fail$`, theCommandShouldFail)
+	ctx.Step(`^the output should not contain "([^"]*)"$`, theOutputShouldNotContain)
+	ctx.Step(`^the output should show "([^"]*)" before "([^"]*)"$`, theOutputShouldShowBefore)
+	ctx.Step(`^the command should exit with code (\d+)$`, theCommandShouldExitWithCode)
+	ctx.Step(`^the output should be valid JSON$`, theOutputShouldBeValidJSON)
+	ctx.Step(`^every output line should be valid JSON$`, everyOutputLineShouldBeValidJSON)
+	ctx.Step(`^the JSON field "([^"]*)" should be "([^"]*)"$`, theJSONFieldShouldBe)
+	ctx.Step(`^the server runs with "([^"]*)"$`, theServerRunsWith)
+	ctx.Step(`^the server restarts$`, theServerRestarts)
+}
+
+// theServerRestarts restarts the server on the stored messages. Agents
+// have to register again, since the registry lives in memory.
+func theServerRestarts() error {
+	startNdadmServer()
+	return nil
+}
+
+// theServerRunsWith restarts the server with an extra config setting. The
+// registry lives in memory, so it must come before any registration.
+func theServerRunsWith(setting string) error {
+	startNdadmServer(setting)
+	return nil
 }
 
 func iRun(cmdLine string) error {
@@ -149,3 +178,62 @@ func theCommandShouldFail() error {
 	}
 	return nil
 }
+
+func theOutputShouldNotContain(unexpected string) error {
+	if strings.Contains(lastOutput, unexpected) {
+		return fmt.Errorf("expected output not to contain %q, but got: %s", unexpected, lastOutput)
+	}
+	return nil
+}
+
+func theOutputShouldShowBefore(first, second string) error {
+	i, j := strings.Index(lastOutput, first), strings.Index(lastOutput, second)
+	if i < 0 || j < 0 {
+		return fmt.Errorf("expected output to contain %q and %q, but got: %s", first, second, lastOutput)
+	}
+	if i > j {
+		return fmt.Errorf("expected %q to come before %q, but got: %s", first, second, lastOutput)
+	}
+	return nil
+}
+
+func theCommandShouldExitWithCode(code int) error {
+	actual := 0
+	if exitErr, ok := lastError.(*exec.ExitError); ok {
+		actual = exitErr.ExitCode()
+	} else if lastError != nil {
+		return fmt.Errorf("command did not run: %v", lastError)
+	}
+	if actual != code {
+		return fmt.Errorf("expected exit code %d, got %d. Output: %s", code, actual, lastOutput)
+	}
+	return nil
+}
+
+func theOutputShouldBeValidJSON() error {
+	if !json.Valid([]byte(lastOutput)) {
+		return fmt.Errorf("expected output to be valid JSON, but got: %s", lastOutput)
+	}
+	return nil
+}
+
+func everyOutputLineShouldBeValidJSON() error {
+	lines := strings.Split(strings.TrimSpace(lastOutput), "\n")
+	for _, line := range lines {
+		if !json.Valid([]byte(line)) {
+			return fmt.Errorf("expected every line to be valid JSON, but got line %q in: %s", line, lastOutput)
+		}
+	}
+	return nil
+}
+
+func theJSONFieldShouldBe(field, expected string) error {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(lastOutput), &doc); err != nil {
+		return fmt.Errorf("expected a JSON object, but got: %s", lastOutput)
+	}
+	if actual := fmt.Sprint(doc[field]); actual != expected {
+		return fmt.Errorf("expected field %q to be %q, but got %q in: %s", field, expected, actual, lastOutput)
+	}
+	return nil
+}
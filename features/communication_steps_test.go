@@ -1,12 +1,18 @@
 package features
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/cucumber/godog"
+	"github.com/nats-io/nats.go"
 )
 
 func InitializeCommunicationSteps(ctx *godog.ScenarioContext) {
@@ -47,6 +53,14 @@ func InitializeCommunicationSteps(ctx *godog.ScenarioContext) {
 
 	// Core scenarios
 	ctx.Step(`^agent "([^"]*)" runs "([^"]*)"$`, agentRunsCommand)
+	ctx.Step(`^agent "([^"]*)" starts "([^"]*)" in the background$`, agentStartsCommandInBackground)
+	ctx.Step(`^the background command of agent "([^"]*)" should output "([^"]*)"$`, theBackgroundCommandShouldOutput)
+	ctx.Step(`^agent "([^"]*)" has a git checkout with "([^"]*)" containing "([^"]*)"$`, agentHasAGitCheckout)
+	ctx.Step(`^agent "([^"]*)" runs "([^"]*)" in their checkout$`, agentRunsCommandInCheckout)
+	ctx.Step(`^agent "([^"]*)" sends this request to "([^"]*)":$`, agentSendsThisRequest)
+	ctx.Step(`^this message is stored on "([^"]*)":$`, thisMessageIsStoredOn)
+	ctx.Step(`^the mailbox of agent "([^"]*)" filters on "([^"]*)"$`, theMailboxOfAgentFiltersOn)
+	ctx.Step(`^the payload store should hold (\d+) objects?$`, thePayloadStoreShouldHold)
 	ctx.Step(`^agent "([^"]*)" has sent a need "([^"]*)"$`, agentHasSentANeed)
 	ctx.Step(`^agent "([^"]*)" should receive a message with text "([^"]*)"$`, agentShouldReceiveAMessageWithText)
 	ctx.Step(`^the command should fail with "([^"]*)"$`, theCommandShouldFailWith)
@@ -250,6 +264,230 @@ func agentRunsCommand(agentName, command string) error {
 	return nil
 }
 
+// backgroundCmds holds commands started in the background, by agent name
+var backgroundCmds = map[string]*backgroundCmd{}
+
+type backgroundCmd struct {
+	cmd  *exec.Cmd
+	out  *bytes.Buffer
+	done chan error
+}
+
+func agentStartsCommandInBackground(agentName, command string) error {
+	targetConfFile := fmt.Sprintf(".needy.conf.%s", agentName)
+	input, err := os.ReadFile(targetConfFile)
+	if err != nil {
+		return fmt.Errorf("identity for agent %s not found (did you register them?)", agentName)
+	}
+
+	// Each background agent gets its own directory so identity swaps by
+	// later steps cannot affect it
+	dir := fmt.Sprintf(".agent-%s", agentName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".needy.conf"), input, 0600); err != nil {
+		return err
+	}
+
+	fullCmd := strings.Replace(command, "nd ", "../../bin/nd ", 1)
+	bg := &backgroundCmd{
+		cmd:  exec.Command("bash", "-c", fullCmd),
+		out:  &bytes.Buffer{},
+		done: make(chan error, 1),
+	}
+	bg.cmd.Dir = dir
+	bg.cmd.Stdout = bg.out
+	bg.cmd.Stderr = bg.out
+	if err := bg.cmd.Start(); err != nil {
+		return err
+	}
+	go func() { bg.done <- bg.cmd.Wait() }()
+	backgroundCmds[agentName] = bg
+	return nil
+}
+
+func theBackgroundCommandShouldOutput(agentName, expected string) error {
+	bg, ok := backgroundCmds[agentName]
+	if !ok {
+		return fmt.Errorf("agent %s has no background command", agentName)
+	}
+
+	select {
+	case lastError = <-bg.done:
+	case <-time.After(30 * time.Second):
+		_ = bg.cmd.Process.Kill()
+		return fmt.Errorf("background command of agent %s did not finish", agentName)
+	}
+	lastOutput = bg.out.String()
+	delete(backgroundCmds, agentName)
+
+	if lastError != nil {
+		return fmt.Errorf("background command of agent %s failed: %v. Output: %s", agentName, lastError, lastOutput)
+	}
+	return theOutputShouldContain(expected)
+}
+
+// stopBackgroundCommands kills any background command still running and
+// removes the background agents' directories
+func stopBackgroundCommands() {
+	for name, bg := range backgroundCmds {
+		_ = bg.cmd.Process.Kill()
+		<-bg.done
+		delete(backgroundCmds, name)
+	}
+	dirs, _ := filepath.Glob(".agent-*")
+	for _, d := range dirs {
+		_ = os.RemoveAll(d)
+	}
+}
+
+// agentSendsThisRequest sends a JSON request straight to the server,
+// bypassing nd, with the agent's client ID filled in
+func agentSendsThisRequest(agentName, subject string, body *godog.DocString) error {
+	conf, err := os.ReadFile(fmt.Sprintf(".needy.conf.%s", agentName))
+	if err != nil {
+		return fmt.Errorf("identity for agent %s not found (did you register them?)", agentName)
+	}
+	clientID := ""
+	for _, line := range strings.Split(string(conf), "\n") {
+		if id, ok := strings.CutPrefix(line, "client-id="); ok {
+			clientID = strings.TrimSpace(id)
+		}
+	}
+
+	var req map[string]interface{}
+	if err := json.Unmarshal([]byte(body.Content), &req); err != nil {
+		return fmt.Errorf("request is not valid JSON: %w", err)
+	}
+	req["client_id"] = clientID
+	data, _ := json.Marshal(req)
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", testPort))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	resp, err := nc.Request(subject, data, 5*time.Second)
+	if err != nil {
+		lastOutput, lastError = "", err
+		return nil
+	}
+	lastOutput, lastError = string(resp.Data), nil
+	return nil
+}
+
+// thisMessageIsStoredOn publishes a message straight to the message stream,
+// as an older server would have stored it
+func thisMessageIsStoredOn(subject string, body *godog.DocString) error {
+	nc, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", testPort))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.Publish(subject, []byte(body.Content))
+	return err
+}
+
+// theMailboxOfAgentFiltersOn creates an agent's mailbox consumer with the
+// given comma separated filter subjects, as an older server would have
+func theMailboxOfAgentFiltersOn(agentName, filters string) error {
+	nc, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", testPort))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	_, err = js.AddConsumer("MESSAGES", &nats.ConsumerConfig{
+		Durable:        "AGENT_" + agentName,
+		AckPolicy:      nats.AckExplicitPolicy,
+		DeliverPolicy:  nats.DeliverAllPolicy,
+		FilterSubjects: strings.Split(filters, ","),
+	})
+	return err
+}
+
+// thePayloadStoreShouldHold counts the objects in the PAYLOADS store
+func thePayloadStoreShouldHold(expected int) error {
+	nc, err := nats.Connect(fmt.Sprintf("nats://127.0.0.1:%d", testPort))
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+	obs, err := js.ObjectStore("PAYLOADS")
+	if err != nil {
+		return err
+	}
+	objects, err := obs.List()
+	if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+		return err
+	}
+	if len(objects) != expected {
+		return fmt.Errorf("expected %d objects in the payload store, but found %d", expected, len(objects))
+	}
+	return nil
+}
+
+// checkoutDir is where an agent's git checkout lives during a scenario
+func checkoutDir(agentName string) string {
+	return fmt.Sprintf(".checkout-%s", agentName)
+}
+
+func agentHasAGitCheckout(agentName, file, content string) error {
+	dir := checkoutDir(agentName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(content+"\n"), 0600); err != nil {
+		return err
+	}
+	cmd := exec.Command("bash", "-c", "git init -q && git add -A && git -c user.name=needy -c user.email=needy@example.com commit -qm initial")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create checkout: %v: %s", err, out)
+	}
+	return nil
+}
+
+func agentRunsCommandInCheckout(agentName, command string) error {
+	input, err := os.ReadFile(fmt.Sprintf(".needy.conf.%s", agentName))
+	if err != nil {
+		return fmt.Errorf("identity for agent %s not found (did you register them?)", agentName)
+	}
+	dir := checkoutDir(agentName)
+	if err := os.WriteFile(filepath.Join(dir, ".needy.conf"), input, 0600); err != nil {
+		return err
+	}
+
+	fullCmd := strings.Replace(command, "nd ", "../../bin/nd ", 1)
+	cmd := exec.Command("bash", "-c", fullCmd)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	lastOutput = string(out)
+	lastError = err
+
+	return nil
+}
+
+// removeCheckouts deletes the git checkouts agents made during a scenario
+func removeCheckouts() {
+	dirs, _ := filepath.Glob(".checkout-*")
+	for _, d := range dirs {
+		_ = os.RemoveAll(d)
+	}
+}
+
 func agentHasSentANeed(agentName, needText string) error {
 	return agentRunsCommand(agentName, fmt.Sprintf("nd send need '%s'", needText))
 }
@@ -42,6 +42,10 @@ func InitializeScenario(sc *godog.ScenarioContext) {
 				_ = os.Remove(f)
 			}
 		}
+		// Clean up background agents left over from an aborted run
+		stopBackgroundCommands()
+		removeCheckouts()
+
 		// Clean up .nats-data with retries
 		for i := 0; i < 10; i++ {
 			if err := os.RemoveAll(".nats-data"); err == nil {
@@ -65,6 +69,8 @@ func InitializeScenario(sc *godog.ScenarioContext) {
 
 	// Cleanup after each scenario
 	sc.After(func(ctx context.Context, sc *godog.Scenario, err error) (context.Context, error) {
+		stopBackgroundCommands()
+		removeCheckouts()
 		stopNdadmServer()
 		return ctx, nil
 	})